@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var adminTemplate = template.Must(template.New("admin.tmpl").ParseFiles("templates/admin.tmpl"))
+
+// requireAdmin guards h with HTTP basic auth. The admin pages don't exist
+// unless an admin password has been configured.
+func requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c.AdminPassword == "" {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		if !isAdmin(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="slackinviter admin"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		if r.Method == "POST" && !sameOrigin(r) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// isAdmin reports whether r carries the admin's credentials
+func isAdmin(r *http.Request) bool {
+	user, pass, ok := r.BasicAuth()
+	return ok && c.AdminPassword != "" &&
+		subtle.ConstantTimeCompare([]byte(user), []byte(c.AdminUser)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(pass), []byte(c.AdminPassword)) == 1
+}
+
+// sameOrigin rejects cross site form posts to the admin pages
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// handleAdmin lists the requests waiting for review
+func handleAdmin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	pending, err := invites.Query(inviteQuery{Outcome: outcomePending})
+	if err != nil {
+		log.Println("error querying invite ledger:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	waiting, dead := deliveries.items()
+	// invites that failed outright, the queue has its own dead letters
+	failed, err := invites.Query(inviteQuery{Outcome: outcomeFailed, From: time.Now().AddDate(0, 0, -30)})
+	if err != nil {
+		log.Println("error querying invite ledger:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	retryable := failed[:0]
+	for _, rec := range failed {
+		if !deliveries.holds(rec.ID) {
+			retryable = append(retryable, rec)
+		}
+	}
+	search, found, err := searchLedger(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var profiles []string
+	for name := range getSettings().Profiles {
+		profiles = append(profiles, name)
+	}
+	sort.Strings(profiles)
+
+	var buf bytes.Buffer
+	err = adminTemplate.Execute(&buf, struct {
+		Team     *team
+		Pending  []inviteRecord
+		Failed   []inviteRecord
+		Waiting  []deliveryItem
+		Dead     []deliveryItem
+		Codes    []inviteCode
+		Profiles []string
+		Now      time.Time
+		Breaker  *breakerStatus
+		Search   ledgerSearch
+		Found    []inviteRecord
+		Outcomes []string
+	}{
+		ourTeam,
+		pending,
+		retryable,
+		waiting,
+		dead,
+		codes.all(),
+		profiles,
+		time.Now(),
+		captchaBreakerStatus(),
+		search,
+		found,
+		ledgerOutcomes,
+	})
+	renderResult("admin", err)
+	if err != nil {
+		log.Println("error rendering admin template:", err)
+		http.Error(w, "error rendering template :-(", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+// ledgerSearch is the ledger search form on /admin/, as submitted
+type ledgerSearch struct {
+	Email, From, To, Outcome string
+	Done                     bool // something was searched for
+	More                     bool // there were more results than shown
+}
+
+// maxLedgerResults caps how many records a search shows, newest first
+const maxLedgerResults = 200
+
+// searchLedger looks up the requests matching the search form in v, by
+// email, date range (From and To inclusive, as 2006-01-02) and outcome
+func searchLedger(v url.Values) (ledgerSearch, []inviteRecord, error) {
+	s := ledgerSearch{
+		Email:   strings.TrimSpace(v.Get("email")),
+		From:    v.Get("from"),
+		To:      v.Get("to"),
+		Outcome: v.Get("outcome"),
+	}
+	if s.Email == "" && s.From == "" && s.To == "" && s.Outcome == "" {
+		return s, nil, nil
+	}
+	s.Done = true
+	q := inviteQuery{Email: s.Email, Outcome: s.Outcome}
+	var err error
+	if s.From != "" {
+		if q.From, err = time.Parse("2006-01-02", s.From); err != nil {
+			return s, nil, fmt.Errorf("bad from date %q", s.From)
+		}
+	}
+	if s.To != "" {
+		if q.To, err = time.Parse("2006-01-02", s.To); err != nil {
+			return s, nil, fmt.Errorf("bad to date %q", s.To)
+		}
+		q.To = q.To.AddDate(0, 0, 1)
+	}
+	found, err := invites.Query(q)
+	if err != nil {
+		return s, nil, err
+	}
+	// newest first
+	for i, j := 0, len(found)-1; i < j; i, j = i+1, j-1 {
+		found[i], found[j] = found[j], found[i]
+	}
+	if len(found) > maxLedgerResults {
+		found, s.More = found[:maxLedgerResults], true
+	}
+	return s, found, nil
+}
+
+// handleApprove sends the invite for a pending request
+func handleApprove(w http.ResponseWriter, r *http.Request) {
+	rec, ok := claimRecord(w, r, outcomePending, func(rec *inviteRecord) {
+		rec.Outcome = outcomeSending
+	})
+	if !ok {
+		return
+	}
+	sendReviewed(w, r, &rec)
+}
+
+// handleRetry tries a failed invite again
+func handleRetry(w http.ResponseWriter, r *http.Request) {
+	if deliveries.holds(r.FormValue("id")) {
+		http.Error(w, "That invite is on the delivery queue, replay it from there", http.StatusConflict)
+		return
+	}
+	rec, ok := claimRecord(w, r, outcomeFailed, func(rec *inviteRecord) {
+		rec.Outcome = outcomeSending
+	})
+	if !ok {
+		return
+	}
+	sendReviewed(w, r, &rec)
+}
+
+// sendReviewed sends the invite for a request a moderator has claimed
+func sendReviewed(w http.ResponseWriter, r *http.Request, rec *inviteRecord) {
+	if c.AsyncInvites {
+		rec.Outcome = outcomeQueued
+		recordInvite(rec)
+		http.Redirect(w, r, "/admin/", http.StatusSeeOther)
+		return
+	}
+	ie := sendInvite(rec)
+	logInvite(rec)
+	if ie != nil {
+		http.Error(w, "Slack refused the invite: "+ie.Error(), ie.Status)
+		return
+	}
+	http.Redirect(w, r, "/admin/", http.StatusSeeOther)
+}
+
+// recoverInterrupted marks requests still being sent when the process last
+// stopped as failed, so they show up on /admin/ to be retried. Whether
+// slack got them is anyone's guess; a second invite is refused as
+// already_invited, which is harmless.
+func recoverInterrupted() error {
+	stuck, err := invites.Query(inviteQuery{Outcome: outcomeSending})
+	if err != nil {
+		return err
+	}
+	for _, rec := range stuck {
+		_, _, err := invites.Transition(rec.ID, outcomeSending, func(rec *inviteRecord) {
+			rec.Outcome = outcomeFailed
+			rec.Code = codeInternalError
+			rec.Error = "interrupted while sending, it may have gone through"
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(stuck) > 0 {
+		log.Printf("%d invites were interrupted while sending, they can be retried on /admin/", len(stuck))
+	}
+	return nil
+}
+
+// handleDeny turns down a pending request
+func handleDeny(w http.ResponseWriter, r *http.Request) {
+	_, ok := claimRecord(w, r, outcomePending, func(rec *inviteRecord) {
+		rec.Outcome = outcomeDenied
+		rec.Reason = r.FormValue("reason")
+	})
+	if !ok {
+		return
+	}
+	http.Redirect(w, r, "/admin/", http.StatusSeeOther)
+}
+
+// handleReload re-reads the settings file
+func handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err := reloadSettings(); err != nil {
+		log.Println("error reloading settings:", err)
+		http.Error(w, "Error reloading settings: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/admin/", http.StatusSeeOther)
+}
+
+// handleReplay puts a dead letter back on the delivery queue
+func handleReplay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err := deliveries.replay(r.FormValue("id")); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Redirect(w, r, "/admin/", http.StatusSeeOther)
+}
+
+// handleCreateCode issues a new invite code
+func handleCreateCode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	ic := inviteCode{
+		Label:          r.FormValue("label"),
+		MaxUses:        1,
+		Expires:        time.Now().AddDate(0, 0, 30).UTC(),
+		Profile:        r.FormValue("profile"),
+		SkipCaptcha:    r.FormValue("skip_captcha") == "1",
+		SkipModeration: r.FormValue("skip_moderation") == "1",
+	}
+	ic.CreatedBy, _, _ = r.BasicAuth()
+	if v := r.FormValue("max_uses"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Max uses must be a positive number", http.StatusBadRequest)
+			return
+		}
+		ic.MaxUses = n
+	}
+	if v := r.FormValue("expires"); v != "" {
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			http.Error(w, "Expiry must be a date like 2006-01-02", http.StatusBadRequest)
+			return
+		}
+		// good until the end of that day
+		ic.Expires = t.AddDate(0, 0, 1).UTC()
+	}
+	if ic.Profile != "" {
+		if _, err := getSettings().profile(ic.Profile); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if _, err := codes.create(ic); err != nil {
+		log.Println("error saving invite code:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/admin/", http.StatusSeeOther)
+}
+
+// claimRecord moves the request named by the id form value on from the
+// outcome from, marking it reviewed and applying fn, or writes an error
+// response if there's no such request or someone else got there first
+func claimRecord(w http.ResponseWriter, r *http.Request, from string, fn func(*inviteRecord)) (inviteRecord, bool) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return inviteRecord{}, false
+	}
+	rec, ok, err := invites.Transition(r.FormValue("id"), from, func(rec *inviteRecord) {
+		rec.ReviewedBy, _, _ = r.BasicAuth()
+		rec.ReviewedAt = time.Now().UTC()
+		fn(rec)
+	})
+	if err != nil {
+		log.Println("error writing invite ledger:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return inviteRecord{}, false
+	}
+	if rec.ID == "" {
+		http.Error(w, "No such request", http.StatusNotFound)
+		return inviteRecord{}, false
+	}
+	if !ok {
+		http.Error(w, "Request has already been dealt with", http.StatusConflict)
+		return inviteRecord{}, false
+	}
+	return rec, true
+}
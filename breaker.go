@@ -0,0 +1,115 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states
+const (
+	breakerClosed   = "closed"    // calls go through
+	breakerOpen     = "open"      // calls fail fast until the cooldown is up
+	breakerHalfOpen = "half_open" // one trial call is let through
+)
+
+// breaker is a circuit breaker. After threshold failures in a row it opens
+// and refuses calls for cooldown, then lets a single call through to see if
+// things are better.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	trips     *expvar.Int
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newBreaker(threshold int, cooldown time.Duration, trips *expvar.Int) *breaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &breaker{threshold: threshold, cooldown: cooldown, trips: trips, state: breakerClosed}
+}
+
+// allow reports whether a call may go ahead. Every allowed call must be
+// followed by success or failure.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = breakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *breaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+		b.trips.Add(1)
+	}
+}
+
+// abort gives up on an allowed call without saying how it went
+func (b *breaker) abort() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// refusing reports whether allow would refuse a call right now, without
+// taking the trial call
+func (b *breaker) refusing() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		return time.Since(b.openedAt) < b.cooldown
+	case breakerHalfOpen:
+		return b.probing
+	}
+	return false
+}
+
+// breakerStatus is a breaker's state, for metrics and health checks
+type breakerStatus struct {
+	State    string    `json:"state"`
+	Failures int       `json:"failures"` // in a row
+	OpenedAt time.Time `json:"opened_at,omitempty"`
+}
+
+func (b *breaker) status() breakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := breakerStatus{State: b.state, Failures: b.failures}
+	if b.state != breakerClosed {
+		st.OpenedAt = b.openedAt
+	}
+	return st
+}
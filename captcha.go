@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// captchaResult is a provider's verdict on a captcha response
+type captchaResult struct {
+	Success  bool
+	Score    float64 // 0 (bot) to 1 (human), only from reCAPTCHA v3
+	HasScore bool
+	Action   string
+	Hostname string
+}
+
+// captchaWidget is what the invite form needs to show a provider's widget
+type captchaWidget struct {
+	Provider      string
+	Challenge     string // for providers that need a fresh challenge per page
+	Script        string // URL of the provider's javascript, if any
+	Class         string // class of the element the widget renders into
+	SiteKey       string
+	ResponseField string // form field the widget puts its response in
+}
+
+// captchaProvider checks captcha responses
+type captchaProvider interface {
+	Verify(ctx context.Context, response, remoteIP string) (captchaResult, error)
+	Widget() captchaWidget
+}
+
+// captchaChallenger is a provider that hands out a challenge with each page
+type captchaChallenger interface {
+	Challenge() string
+}
+
+// captchaWidgetWithChallenge returns the widget for a new page
+func captchaWidgetWithChallenge() captchaWidget {
+	p := captcha
+	if g, ok := captcha.(*guardedCaptcha); ok {
+		p = g.current()
+	}
+	w := p.Widget()
+	if ch, ok := p.(captchaChallenger); ok {
+		w.Challenge = ch.Challenge()
+	}
+	return w
+}
+
+// verifyCaptcha checks a response from the named provider's widget. An
+// empty name means the configured provider.
+func verifyCaptcha(ctx context.Context, provider, response, remoteIP string) (captchaResult, error) {
+	if g, ok := captcha.(*guardedCaptcha); ok {
+		return g.verifyFrom(ctx, provider, response, remoteIP)
+	}
+	return captcha.Verify(ctx, response, remoteIP)
+}
+
+// captchaResponseField is the form field the named provider's widget posts
+// its response in
+func captchaResponseField(provider string) string {
+	if provider == captchaPoW {
+		return powResponseField
+	}
+	return captcha.Widget().ResponseField
+}
+
+// Captcha providers
+const (
+	captchaRecaptcha   = "recaptcha" // reCAPTCHA v2 checkbox
+	captchaRecaptchaV3 = "recaptcha_v3"
+	captchaHCaptcha    = "hcaptcha"
+	captchaTurnstile   = "turnstile"
+	captchaNone        = "none" // for development, lets everything through
+)
+
+// newCaptchaProvider returns the provider named by name
+func newCaptchaProvider(name, siteKey, secret string) (captchaProvider, error) {
+	switch name {
+	case captchaNone:
+		return noCaptcha{}, nil
+	case captchaPoW:
+		return newPoWCaptcha(secret, c.PoWDifficulty, c.PoWMaxDifficulty), nil
+	}
+	if siteKey == "" || secret == "" {
+		return nil, fmt.Errorf("captcha provider %s needs a sitekey and a secret", name)
+	}
+	sv := &siteVerify{
+		secret: secret,
+		client: &http.Client{Timeout: c.CaptchaTimeout},
+		widget: captchaWidget{Provider: name, SiteKey: siteKey},
+	}
+	if c.PublicURL != "" {
+		if u, err := url.Parse(c.PublicURL); err == nil {
+			sv.hostname = u.Hostname()
+		}
+	}
+	switch name {
+	case captchaRecaptcha:
+		sv.endpoint = "https://www.google.com/recaptcha/api/siteverify"
+		sv.widget.Script = "https://www.google.com/recaptcha/api.js"
+		sv.widget.Class = "g-recaptcha"
+		sv.widget.ResponseField = "g-recaptcha-response"
+	case captchaRecaptchaV3:
+		// v3 has no widget, client.js asks for a token on submit
+		sv.endpoint = "https://www.google.com/recaptcha/api/siteverify"
+		sv.widget.Script = "https://www.google.com/recaptcha/api.js?render=" + url.QueryEscape(siteKey)
+		sv.scored = true
+		sv.action = captchaAction
+	case captchaHCaptcha:
+		sv.endpoint = "https://api.hcaptcha.com/siteverify"
+		sv.widget.Script = "https://js.hcaptcha.com/1/api.js"
+		sv.widget.Class = "h-captcha"
+		sv.widget.ResponseField = "h-captcha-response"
+		sv.sendSiteKey = true
+	case captchaTurnstile:
+		sv.endpoint = "https://challenges.cloudflare.com/turnstile/v0/siteverify"
+		sv.widget.Script = "https://challenges.cloudflare.com/turnstile/v0/api.js"
+		sv.widget.Class = "cf-turnstile"
+		sv.widget.ResponseField = "cf-turnstile-response"
+	default:
+		return nil, fmt.Errorf("unknown captcha provider %q", name)
+	}
+	g := &guardedCaptcha{
+		captchaProvider: sv,
+		timeout:         c.CaptchaTimeout,
+		breaker:         newBreaker(c.CaptchaFailures, c.CaptchaCooldown, &captchaBreakerTrips),
+	}
+	if c.CaptchaDegraded == degradedPoW {
+		g.fallback = newPoWCaptcha(c.FormSecret, c.PoWDifficulty, c.PoWMaxDifficulty)
+	}
+	return g, nil
+}
+
+// captchaAction is the reCAPTCHA v3 action client.js asks for a token for
+const captchaAction = "invite"
+
+// siteVerify checks responses against a siteverify style endpoint, which
+// reCAPTCHA, hCaptcha and Turnstile all provide
+type siteVerify struct {
+	endpoint    string
+	secret      string
+	sendSiteKey bool
+	client      *http.Client
+	widget      captchaWidget
+	// scored is set for reCAPTCHA v3. Other providers may send a score
+	// too, but hCaptcha Enterprise's runs the other way, so it's ignored.
+	scored bool
+	// action and hostname, when set, are what the token must have been
+	// made for, so tokens taken from other pages or sites are refused
+	action   string
+	hostname string
+}
+
+// captchaError is a response the provider refused, with its error codes
+type captchaError struct {
+	Codes []string
+}
+
+func (e *captchaError) Error() string {
+	return "validation failed: " + strings.Join(e.Codes, ", ")
+}
+
+func (sv *siteVerify) Verify(ctx context.Context, response, remoteIP string) (captchaResult, error) {
+	values := url.Values{"secret": {sv.secret}, "response": {response}}
+	if remoteIP != "" {
+		values.Set("remoteip", remoteIP)
+	}
+	if sv.sendSiteKey {
+		values.Set("sitekey", sv.widget.SiteKey)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", sv.endpoint, strings.NewReader(values.Encode()))
+	if err != nil {
+		return captchaResult{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := sv.client.Do(req)
+	if err != nil {
+		return captchaResult{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return captchaResult{}, fmt.Errorf("%s returned %s", sv.endpoint, resp.Status)
+	}
+
+	var v struct {
+		Success    bool     `json:"success"`
+		Score      *float64 `json:"score"`
+		Action     string   `json:"action"`
+		Hostname   string   `json:"hostname"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return captchaResult{}, err
+	}
+	if !v.Success && len(v.ErrorCodes) != 0 {
+		return captchaResult{}, &captchaError{Codes: v.ErrorCodes}
+	}
+	res := captchaResult{Success: v.Success, Action: v.Action, Hostname: v.Hostname}
+	if sv.scored && v.Score != nil {
+		res.Score, res.HasScore = *v.Score, true
+	}
+	if res.Success && sv.action != "" && res.Action != sv.action {
+		log.Printf("captcha token was made for action %q, not %q", res.Action, sv.action)
+		res.Success = false
+	}
+	if res.Success && sv.hostname != "" && !strings.EqualFold(res.Hostname, sv.hostname) {
+		log.Printf("captcha token was made on %q, not %q", res.Hostname, sv.hostname)
+		res.Success = false
+	}
+	return res, nil
+}
+
+func (sv *siteVerify) Widget() captchaWidget {
+	return sv.widget
+}
+
+// Degraded captcha policies, for while the provider can't be reached
+const (
+	degradedReject   = "reject"
+	degradedModerate = "moderate" // let requests through to the moderators
+	degradedPoW      = "pow"      // switch the form to the proof of work captcha
+)
+
+var errBreakerOpen = errors.New("circuit breaker open")
+
+// unavailableError is a provider we couldn't get an answer from, as
+// opposed to one that turned the response down
+type unavailableError struct {
+	Err error
+}
+
+func (e *unavailableError) Error() string {
+	return "provider unavailable: " + e.Err.Error()
+}
+
+// guardedCaptcha wraps a remote provider with a timeout and a circuit
+// breaker. While the breaker refuses calls and there's a fallback, new
+// pages get a proof of work challenge instead. Widget is always the remote
+// provider's; current is what new pages should show.
+type guardedCaptcha struct {
+	captchaProvider
+	timeout  time.Duration
+	breaker  *breaker
+	fallback *powCaptcha // set when the degraded policy is pow
+}
+
+func (g *guardedCaptcha) Verify(ctx context.Context, response, remoteIP string) (captchaResult, error) {
+	return g.verifyFrom(ctx, "", response, remoteIP)
+}
+
+// verifyFrom checks a response from the named provider's widget. Answers
+// to the fallback's challenges go to the fallback whatever the breaker says
+// now, since the page may have been rendered before the provider recovered;
+// the challenges themselves are only handed out while it's down.
+func (g *guardedCaptcha) verifyFrom(ctx context.Context, provider, response, remoteIP string) (captchaResult, error) {
+	if g.fallback != nil && provider == captchaPoW {
+		captchaDegraded.Add(1)
+		return g.fallback.Verify(ctx, response, remoteIP)
+	}
+	if !g.breaker.allow() {
+		captchaUnavailable.Add(1)
+		return captchaResult{}, &unavailableError{errBreakerOpen}
+	}
+	vctx, cancel := context.WithTimeout(ctx, g.timeout)
+	defer cancel()
+	res, err := g.captchaProvider.Verify(vctx, response, remoteIP)
+	if _, refused := err.(*captchaError); err == nil || refused {
+		g.breaker.success()
+		return res, err
+	}
+	if ctx.Err() != nil {
+		// the client went away, that's not the provider's fault
+		g.breaker.abort()
+		return res, err
+	}
+	g.breaker.failure()
+	captchaUnavailable.Add(1)
+	return res, &unavailableError{err}
+}
+
+// current returns the provider new pages should use: the fallback whenever
+// the breaker would refuse to check the remote provider's answer, trial
+// call in flight included
+func (g *guardedCaptcha) current() captchaProvider {
+	if g.fallback != nil && g.breaker.refusing() {
+		return g.fallback
+	}
+	return g.captchaProvider
+}
+
+// captchaBreakerStatus returns the state of the captcha provider's circuit
+// breaker, or nil if the provider doesn't have one
+func captchaBreakerStatus() *breakerStatus {
+	g, ok := captcha.(*guardedCaptcha)
+	if !ok {
+		return nil
+	}
+	st := g.breaker.status()
+	return &st
+}
+
+// What to do with a request given its captcha result
+const (
+	riskInvite   = "invite"
+	riskModerate = "moderate"
+	riskReject   = "reject"
+)
+
+// riskAction maps a captcha result to an action. Providers that only say
+// yes or no invite or reject; scores at or above ScoreInvite invite, at or
+// above ScoreModerate go to the moderators and anything lower is rejected.
+func riskAction(res captchaResult) string {
+	var action string
+	switch {
+	case !res.Success:
+		action = riskReject
+	case !res.HasScore || res.Score >= c.ScoreInvite:
+		action = riskInvite
+	case res.Score >= c.ScoreModerate:
+		action = riskModerate
+	default:
+		action = riskReject
+	}
+	if res.HasScore {
+		switch action {
+		case riskInvite:
+			scoreInvite.Add(1)
+		case riskModerate:
+			scoreModerate.Add(1)
+		case riskReject:
+			scoreReject.Add(1)
+		}
+	}
+	return action
+}
+
+// describeCaptcha is how a verdict is recorded in the ledger
+func describeCaptcha(verdict string, res captchaResult) string {
+	if res.HasScore {
+		return fmt.Sprintf("%s (score %.1f)", verdict, res.Score)
+	}
+	return verdict
+}
+
+// noCaptcha accepts everything
+type noCaptcha struct{}
+
+func (noCaptcha) Verify(context.Context, string, string) (captchaResult, error) {
+	return captchaResult{Success: true}, nil
+}
+
+func (noCaptcha) Widget() captchaWidget {
+	return captchaWidget{Provider: captchaNone}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"expvar"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// flakyCaptcha is a remote provider that's either down or accepts
+// everything
+type flakyCaptcha struct {
+	down bool
+}
+
+func (f *flakyCaptcha) Verify(context.Context, string, string) (captchaResult, error) {
+	if f.down {
+		return captchaResult{}, errors.New("connection refused")
+	}
+	return captchaResult{Success: true}, nil
+}
+
+func (f *flakyCaptcha) Widget() captchaWidget {
+	return captchaWidget{Provider: captchaTurnstile, ResponseField: "cf-turnstile-response"}
+}
+
+func solveChallenge(challenge string) string {
+	for i := 0; ; i++ {
+		response := challenge + ":" + strconv.Itoa(i)
+		sum := sha256.Sum256([]byte(response))
+		if leadingZeroBits(sum[:]) >= 4 {
+			return response
+		}
+	}
+}
+
+func TestGuardedCaptchaFallback(t *testing.T) {
+	remote := &flakyCaptcha{down: true}
+	g := &guardedCaptcha{
+		captchaProvider: remote,
+		timeout:         time.Second,
+		breaker:         newBreaker(1, time.Hour, new(expvar.Int)),
+		fallback:        newPoWCaptcha("secret", 4, 4),
+	}
+	ctx := context.Background()
+	if g.current() != remote {
+		t.Fatal("new pages get the fallback before the provider has failed")
+	}
+	if _, err := g.verifyFrom(ctx, captchaTurnstile, "token", ""); err == nil {
+		t.Fatal("a provider that's down answered")
+	}
+	if g.current() != g.fallback {
+		t.Fatal("new pages don't get the fallback while the breaker is open")
+	}
+	answer := solveChallenge(g.fallback.Challenge())
+
+	// the provider recovers before the page is submitted
+	remote.down = false
+	g.breaker.success()
+	if g.current() != remote {
+		t.Fatal("new pages still get the fallback once the provider is back")
+	}
+	if res, err := g.verifyFrom(ctx, captchaPoW, answer, ""); err != nil || !res.Success {
+		t.Errorf("a solved challenge from a page rendered while degraded = %+v, %v; want success", res, err)
+	}
+	if res, err := g.verifyFrom(ctx, captchaTurnstile, "token", ""); err != nil || !res.Success {
+		t.Errorf("the provider's own answer = %+v, %v; want success", res, err)
+	}
+}
+
+func TestGuardedCaptchaHalfOpen(t *testing.T) {
+	g := &guardedCaptcha{
+		captchaProvider: &flakyCaptcha{down: true},
+		timeout:         time.Second,
+		breaker:         newBreaker(1, 0, new(expvar.Int)),
+		fallback:        newPoWCaptcha("secret", 4, 4),
+	}
+	g.breaker.failure()
+	// the cooldown is over, so this takes the one trial call
+	if !g.breaker.allow() {
+		t.Fatal("the breaker didn't let a trial call through")
+	}
+	if g.current() != g.fallback {
+		t.Error("new pages get the remote provider while a trial call is in flight")
+	}
+	if _, err := g.verifyFrom(context.Background(), captchaTurnstile, "token", ""); err == nil {
+		t.Error("a second call went through while the trial call was in flight")
+	}
+}
+
+func TestSiteVerifyChecks(t *testing.T) {
+	var answer string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, answer)
+	}))
+	defer srv.Close()
+	withConfig(t, func(c *Specification) {
+		c.PublicURL = "https://invite.example.com"
+		c.CaptchaTimeout = time.Second
+	})
+	provider := func(name string) *siteVerify {
+		p, err := newCaptchaProvider(name, "sitekey", "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sv := p.(*guardedCaptcha).captchaProvider.(*siteVerify)
+		sv.endpoint = srv.URL
+		return sv
+	}
+	v3, hcaptcha := provider(captchaRecaptchaV3), provider(captchaHCaptcha)
+	tests := []struct {
+		name     string
+		sv       *siteVerify
+		answer   string
+		success  bool
+		hasScore bool
+	}{
+		{"v3", v3, `{"success":true,"score":0.9,"action":"invite","hostname":"invite.example.com"}`, true, true},
+		{"v3 for another action", v3, `{"success":true,"score":0.9,"action":"login","hostname":"invite.example.com"}`, false, true},
+		{"v3 from another site", v3, `{"success":true,"score":0.9,"action":"invite","hostname":"evil.example"}`, false, true},
+		// hCaptcha Enterprise scores run from 0 (human) to 1 (bot)
+		{"hcaptcha score", hcaptcha, `{"success":true,"score":0.9,"hostname":"invite.example.com"}`, true, false},
+		{"hcaptcha from another site", hcaptcha, `{"success":true,"hostname":"evil.example"}`, false, false},
+	}
+	for _, tt := range tests {
+		answer = tt.answer
+		res, err := tt.sv.Verify(context.Background(), "token", "")
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if res.Success != tt.success || res.HasScore != tt.hasScore {
+			t.Errorf("%s: success %v, has score %v; want %v, %v", tt.name, res.Success, res.HasScore, tt.success, tt.hasScore)
+		}
+	}
+}
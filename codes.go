@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// inviteCode lets people an admin handed it to skip the captcha and/or
+// moderation, e.g. at a meetup
+type inviteCode struct {
+	Code           string       `json:"code"`
+	Label          string       `json:"label"` // where the code was handed out
+	MaxUses        int          `json:"max_uses"`
+	Expires        time.Time    `json:"expires"`
+	Profile        string       `json:"profile,omitempty"`
+	SkipCaptcha    bool         `json:"skip_captcha"`
+	SkipModeration bool         `json:"skip_moderation"`
+	Created        time.Time    `json:"created"`
+	CreatedBy      string       `json:"created_by"`
+	Redemptions    []redemption `json:"redemptions"`
+}
+
+// redemption is a request that used an invite code
+type redemption struct {
+	RecordID string    `json:"record_id"`
+	Email    string    `json:"email"`
+	Time     time.Time `json:"time"`
+}
+
+// Uses returns how many times the code has been used
+func (ic *inviteCode) Uses() int {
+	return len(ic.Redemptions)
+}
+
+// usable reports whether the code can be redeemed at now
+func (ic *inviteCode) usable(now time.Time) bool {
+	return now.Before(ic.Expires) && ic.Uses() < ic.MaxUses
+}
+
+var errCodeUnusable = errors.New("invite code is unknown, expired or used up")
+
+// codeStore keeps invite codes in a JSON file that is rewritten on every
+// change
+type codeStore struct {
+	path string
+
+	mu    sync.Mutex
+	codes map[string]*inviteCode
+}
+
+func openCodeStore(path string) (*codeStore, error) {
+	s := &codeStore{path: path, codes: make(map[string]*inviteCode)}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var codes []*inviteCode
+	if err := json.Unmarshal(b, &codes); err != nil {
+		return nil, err
+	}
+	for _, ic := range codes {
+		s.codes[ic.Code] = ic
+	}
+	return s, nil
+}
+
+// create stores a new code built from tmpl, filling in the code itself
+func (s *codeStore) create(tmpl inviteCode) (inviteCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		tmpl.Code = newInviteCode()
+		if _, ok := s.codes[tmpl.Code]; !ok {
+			break
+		}
+	}
+	tmpl.Created = time.Now().UTC()
+	s.codes[tmpl.Code] = &tmpl
+	return tmpl, s.saveLocked()
+}
+
+// lookup returns the code if it can still be redeemed
+func (s *codeStore) lookup(code string) (inviteCode, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ic, ok := s.codes[normalizeInviteCode(code)]
+	if !ok || !ic.usable(time.Now()) {
+		return inviteCode{}, false
+	}
+	return *ic, true
+}
+
+// redeem uses up one of the code's uses for rec
+func (s *codeStore) redeem(code string, rec *inviteRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ic, ok := s.codes[normalizeInviteCode(code)]
+	if !ok || !ic.usable(time.Now()) {
+		return errCodeUnusable
+	}
+	ic.Redemptions = append(ic.Redemptions, redemption{
+		RecordID: rec.ID,
+		Email:    rec.Email,
+		Time:     rec.Time,
+	})
+	return s.saveLocked()
+}
+
+// all returns every code, newest first
+func (s *codeStore) all() []inviteCode {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]inviteCode, 0, len(s.codes))
+	for _, ic := range s.codes {
+		out = append(out, *ic)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.After(out[j].Created) })
+	return out
+}
+
+// saveLocked writes the codes to disk. s.mu must be held.
+func (s *codeStore) saveLocked() error {
+	codes := make([]*inviteCode, 0, len(s.codes))
+	for _, ic := range s.codes {
+		codes = append(codes, ic)
+	}
+	b, err := json.MarshalIndent(codes, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// codeAlphabet leaves out characters that are easy to mix up when a code
+// is read off a slide
+const codeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+func newInviteCode() string {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	for i := range b {
+		b[i] = codeAlphabet[int(b[i])%len(codeAlphabet)]
+	}
+	return string(b)
+}
+
+func normalizeInviteCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var confirmTemplate = template.Must(template.New("confirm.tmpl").ParseFiles("templates/confirm.tmpl"))
+
+// Text on the confirmation page, see messages.go
+const (
+	msgConfirmPrompt = "confirm_prompt"
+	msgConfirmButton = "confirm_button"
+)
+
+// confirmToken returns a signed token for the ledger record id that is
+// good until expires
+func confirmToken(id string, expires time.Time) string {
+	payload := id + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + signConfirm(payload)
+}
+
+func signConfirm(payload string) string {
+	mac := hmac.New(sha256.New, []byte(c.ConfirmSecret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+var errConfirmExpired = errors.New("confirmation link has expired")
+
+// parseConfirmToken checks a token's signature and expiry and returns the
+// record id in it
+func parseConfirmToken(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed confirmation token")
+	}
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(signConfirm(payload))) {
+		return "", errors.New("bad confirmation token signature")
+	}
+	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", err
+	}
+	if time.Now().After(time.Unix(exp, 0)) {
+		return parts[0], errConfirmExpired
+	}
+	return parts[0], nil
+}
+
+// sendConfirmation emails rec a link that completes their request
+func sendConfirmation(rec *inviteRecord, lang string) error {
+	link := strings.TrimSuffix(c.PublicURL, "/") + "/confirm/?" + url.Values{
+		"token": {confirmToken(rec.ID, time.Now().Add(c.ConfirmTTL))},
+		"lang":  {lang},
+	}.Encode()
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", c.SMTPFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", rec.Email)
+	fmt.Fprintf(&msg, "Subject: Confirm your invite to %s on Slack\r\n", ourTeam.Name())
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "Hi %s,\r\n\r\n", rec.FirstName)
+	fmt.Fprintf(&msg, "Someone, hopefully you, asked for an invite to %s on Slack.\r\n", ourTeam.Name())
+	fmt.Fprintf(&msg, "Open this link within %s to confirm it's you:\r\n\r\n%s\r\n\r\n", c.ConfirmTTL, link)
+	fmt.Fprintf(&msg, "If it wasn't you, just ignore this email.\r\n")
+
+	var auth smtp.Auth
+	if c.SMTPUser != "" {
+		auth = smtp.PlainAuth("", c.SMTPUser, c.SMTPPassword, c.SMTPHost)
+	}
+	return sendMail(c.SMTPHost, c.SMTPPort, auth, c.SMTPFrom, rec.Email, msg.Bytes())
+}
+
+// sendMail is smtp.SendMail with a deadline, SMTPTimeout, on the whole
+// conversation so that a stuck relay can't hold up the request
+func sendMail(host string, port int, auth smtp.Auth, from, to string, msg []byte) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), c.SMTPTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(c.SMTPTimeout)); err != nil {
+		return err
+	}
+	cl, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer cl.Close()
+	if ok, _ := cl.Extension("STARTTLS"); ok {
+		if err := cl.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if ok, _ := cl.Extension("AUTH"); !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+		if err := cl.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := cl.Mail(from); err != nil {
+		return err
+	}
+	if err := cl.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := cl.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return cl.Quit()
+}
+
+// handleConfirm shows the page the emailed link points at, and completes
+// the request when its button is pressed. Following the link alone does
+// nothing, since mail scanners and link previews follow links too.
+func handleConfirm(w http.ResponseWriter, r *http.Request) {
+	lang := r.FormValue("lang")
+	if _, ok := messages[lang]; !ok {
+		lang = requestLang(r)
+	}
+	token := r.FormValue("token")
+	var result, pending string
+	var ie *inviteError
+	switch r.Method {
+	case "GET":
+		if ie = checkConfirmToken(token); ie == nil {
+			result, pending = msgConfirmPrompt, token
+		}
+	case "POST":
+		result, ie = confirmInvite(token)
+	default:
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	status, msg := http.StatusOK, ""
+	if ie != nil {
+		status, msg = ie.Status, ie.Message(lang)
+	} else {
+		msg = message(lang, result)
+	}
+
+	var buf bytes.Buffer
+	err := confirmTemplate.Execute(&buf, struct {
+		Team    *team
+		Message string
+		OK      bool
+		Token   string // set while there's a button to press
+		Lang    string
+		Button  string
+	}{
+		ourTeam,
+		msg,
+		ie == nil,
+		pending,
+		lang,
+		message(lang, msgConfirmButton),
+	})
+	renderResult("confirm", err)
+	if err != nil {
+		log.Println("error rendering confirm template:", err)
+		http.Error(w, "error rendering template :-(", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
+
+// checkConfirmToken checks that token names a request still waiting for
+// confirmation, without confirming it
+func checkConfirmToken(token string) *inviteError {
+	id, err := parseConfirmToken(token)
+	if err == errConfirmExpired {
+		return newInviteError(codeConfirmExpired, err)
+	}
+	if err != nil {
+		return newInviteError(codeConfirmInvalid, err)
+	}
+	rec, ok, err := invites.Get(id)
+	if err != nil {
+		log.Println("error reading invite ledger:", err)
+		return newInviteError(codeInternalError, err)
+	}
+	if !ok || rec.Outcome != outcomeUnconfirmed {
+		return newInviteError(codeConfirmInvalid, errors.New("request isn't waiting for confirmation"))
+	}
+	return nil
+}
+
+// confirmInvite moves the unconfirmed request named by token on. The
+// request is claimed in the ledger first, so that it's only sent once
+// however many times the button is pressed.
+func confirmInvite(token string) (string, *inviteError) {
+	id, err := parseConfirmToken(token)
+	if err == errConfirmExpired {
+		confirmationsExpired.Add(1)
+		_, _, err := invites.Transition(id, outcomeUnconfirmed, func(rec *inviteRecord) {
+			rec.Outcome = outcomeRejected
+			rec.Code = codeConfirmExpired
+		})
+		if err != nil {
+			log.Println("error writing invite ledger:", err)
+		}
+		return "", newInviteError(codeConfirmExpired, errConfirmExpired)
+	}
+	if err != nil {
+		return "", newInviteError(codeConfirmInvalid, err)
+	}
+	rec, ok, err := invites.Transition(id, outcomeUnconfirmed, func(rec *inviteRecord) {
+		rec.Outcome = outcomeSending
+	})
+	if err != nil {
+		log.Println("error writing invite ledger:", err)
+		return "", newInviteError(codeInternalError, err)
+	}
+	if !ok {
+		return "", newInviteError(codeConfirmInvalid, errors.New("request isn't waiting for confirmation"))
+	}
+	confirmationsCompleted.Add(1)
+	defer recordInvite(&rec)
+	return dispatchInvite(&rec)
+}
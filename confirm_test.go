@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// catchAll is a minimal SMTP server that accepts every message, like the
+// catch-all servers people test against locally
+type catchAll struct {
+	ln   net.Listener
+	mu   sync.Mutex
+	msgs []string
+}
+
+func newCatchAll(t *testing.T) *catchAll {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &catchAll{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *catchAll) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 catchall ready")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.Fields(line + " x")[0]); cmd {
+		case "EHLO", "HELO":
+			reply("250 catchall")
+		case "DATA":
+			reply("354 go ahead")
+			var msg strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				msg.WriteString(l)
+			}
+			s.mu.Lock()
+			s.msgs = append(s.msgs, msg.String())
+			s.mu.Unlock()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func (s *catchAll) port() int {
+	return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+func (s *catchAll) messages() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.msgs...)
+}
+
+// withConfig lets fn change the configuration for the duration of the test
+func withConfig(t *testing.T, fn func(*Specification)) {
+	old := c
+	fn(&c)
+	t.Cleanup(func() { c = old })
+}
+
+var linkRE = regexp.MustCompile(`https://invite\.example\.com/confirm/\?\S+`)
+
+func TestSendConfirmation(t *testing.T) {
+	srv := newCatchAll(t)
+	withConfig(t, func(c *Specification) {
+		c.SMTPHost = "127.0.0.1"
+		c.SMTPPort = srv.port()
+		c.SMTPFrom = "invites@example.com"
+		c.SMTPTimeout = 5 * time.Second
+		c.ConfirmSecret = "secret"
+		c.ConfirmTTL = time.Hour
+		c.PublicURL = "https://invite.example.com/"
+	})
+	rec := &inviteRecord{ID: "abc123", Email: "gopher@example.com", FirstName: "Go"}
+	if err := sendConfirmation(rec, "de"); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := srv.messages()
+	if len(msgs) != 1 {
+		t.Fatalf("got %d messages, want 1", len(msgs))
+	}
+	if !strings.Contains(msgs[0], "To: gopher@example.com\r\n") {
+		t.Errorf("message isn't addressed to gopher@example.com:\n%s", msgs[0])
+	}
+	link := linkRE.FindString(msgs[0])
+	if link == "" {
+		t.Fatalf("no link to PublicURL in message:\n%s", msgs[0])
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lang := u.Query().Get("lang"); lang != "de" {
+		t.Errorf("link has lang %q, want de", lang)
+	}
+	if id, err := parseConfirmToken(u.Query().Get("token")); err != nil || id != rec.ID {
+		t.Errorf("link token is for %q, %v; want %q", id, err, rec.ID)
+	}
+}
+
+func TestSendConfirmationStuckRelay(t *testing.T) {
+	// a relay that accepts the connection and never says a word
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				break
+			}
+			conns = append(conns, conn)
+		}
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	withConfig(t, func(c *Specification) {
+		c.SMTPHost = "127.0.0.1"
+		c.SMTPPort = ln.Addr().(*net.TCPAddr).Port
+		c.SMTPFrom = "invites@example.com"
+		c.SMTPTimeout = 200 * time.Millisecond
+		c.PublicURL = "https://invite.example.com"
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- sendConfirmation(&inviteRecord{ID: "abc123", Email: "gopher@example.com"}, "en")
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("sending through a stuck relay succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("sending through a stuck relay didn't give up")
+	}
+}
+
+func TestConfirmNeedsPost(t *testing.T) {
+	store, err := openFileStore(filepath.Join(t.TempDir(), "invites.jsonl"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := invites
+	invites = store
+	t.Cleanup(func() { invites = old })
+	withConfig(t, func(c *Specification) {
+		c.ConfirmSecret = "secret"
+	})
+	// moderated, so confirming doesn't need slack
+	rec := inviteRecord{ID: "abc123", Email: "gopher@example.com", Outcome: outcomeUnconfirmed, Moderate: true}
+	if err := store.Put(rec); err != nil {
+		t.Fatal(err)
+	}
+	token := confirmToken(rec.ID, time.Now().Add(time.Hour))
+
+	// link scanners only ever GET
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handleConfirm(w, httptest.NewRequest("GET", "/confirm/?token="+url.QueryEscape(token), nil))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `method="post"`) {
+			t.Fatalf("GET answered %d without a confirm button:\n%s", w.Code, w.Body)
+		}
+	}
+	if got, _, _ := store.Get(rec.ID); got.Outcome != outcomeUnconfirmed {
+		t.Fatalf("after GET the request is %s, want it still %s", got.Outcome, outcomeUnconfirmed)
+	}
+
+	// however many times the button is pressed, the request moves on once
+	var wg sync.WaitGroup
+	statuses := make(chan int, 10)
+	for i := 0; i < cap(statuses); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/confirm/", strings.NewReader(url.Values{"token": {token}}.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			handleConfirm(w, r)
+			statuses <- w.Code
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+	ok := 0
+	for code := range statuses {
+		if code == http.StatusOK {
+			ok++
+		}
+	}
+	if ok != 1 {
+		t.Errorf("%d confirmations went through, want 1", ok)
+	}
+	if got, _, _ := store.Get(rec.ID); got.Outcome != outcomePending {
+		t.Errorf("after confirming the request is %s, want %s", got.Outcome, outcomePending)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// resolver is the part of *net.Resolver used to check that an email
+// domain can receive mail. Swap dnsResolver out to check addresses without
+// a network.
+type resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+var dnsResolver resolver = net.DefaultResolver
+
+const dnsTimeout = 3 * time.Second
+
+// Actions for addresses that are well formed but look like trouble
+const (
+	suspiciousReject   = "reject"
+	suspiciousModerate = "moderate"
+)
+
+// checkEmail validates email. Malformed addresses are always rejected.
+// Disposable or undeliverable ones return a code and suspicious set, so
+// the caller can apply the configured policy.
+func checkEmail(ctx context.Context, email string) (code string, suspicious bool, err error) {
+	addr, err := mail.ParseAddress(email)
+	if err != nil {
+		return codeMalformedEmail, false, err
+	}
+	if addr.Name != "" || addr.Address != strings.TrimSpace(email) {
+		return codeMalformedEmail, false, errors.New("not a bare address")
+	}
+	domain := emailDomain(addr.Address)
+	if len(addr.Address) > 254 || !strings.Contains(domain, ".") || strings.HasPrefix(domain, "[") {
+		return codeMalformedEmail, false, errors.New("unsupported address")
+	}
+
+	if getSettings().isDisposable(domain) {
+		return codeDisposableEmail, true, fmt.Errorf("%s is a disposable email domain", domain)
+	}
+	if err := checkMailDomain(ctx, domain); err != nil {
+		return codeUndeliverableEmail, true, err
+	}
+	return "", false, nil
+}
+
+// checkMailDomain makes sure domain has somewhere to deliver mail: an MX
+// record or, failing that, an address record. Lookups that fail for any
+// reason other than the name not existing let the address through, we
+// don't want a DNS hiccup to block invites.
+func checkMailDomain(ctx context.Context, domain string) error {
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+	mxs, err := dnsResolver.LookupMX(ctx, domain)
+	if err == nil && len(mxs) > 0 {
+		if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+			// RFC 7505 null MX: the domain explicitly accepts no mail
+			return fmt.Errorf("%s does not accept email", domain)
+		}
+		return nil
+	}
+	if err != nil && !isNotFound(err) {
+		return nil
+	}
+	hosts, err := dnsResolver.LookupHost(ctx, domain)
+	if err == nil && len(hosts) > 0 {
+		return nil
+	}
+	if err != nil && !isNotFound(err) {
+		return nil
+	}
+	return fmt.Errorf("%s has no MX or address records", domain)
+}
+
+func countEmailCheck(code string) {
+	switch code {
+	case codeMalformedEmail:
+		malformedEmail.Add(1)
+	case codeDisposableEmail:
+		disposableEmail.Add(1)
+	case codeUndeliverableEmail:
+		undeliverableEmail.Add(1)
+	}
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// isDisposable reports whether domain, or a domain it's under, is a
+// throwaway mail provider
+func (s *settings) isDisposable(domain string) bool {
+	for d := domain; d != ""; {
+		if s.AllowedDisposableDomains[d] {
+			return false
+		}
+		if s.DisposableDomains[d] || disposableDomains[d] {
+			return true
+		}
+		i := strings.Index(d, ".")
+		if i < 0 {
+			break
+		}
+		d = d[i+1:]
+	}
+	return false
+}
+
+// disposableDomains are well known throwaway mail providers. Add to or
+// override the list with disposable_domains and allowed_disposable_domains
+// in the settings file.
+var disposableDomains = stringSet(
+	"10minutemail.com",
+	"20minutemail.com",
+	"33mail.com",
+	"anonbox.net",
+	"burnermail.io",
+	"discard.email",
+	"dispostable.com",
+	"dropmail.me",
+	"emailondeck.com",
+	"fakeinbox.com",
+	"fakemail.net",
+	"getairmail.com",
+	"getnada.com",
+	"guerrillamail.biz",
+	"guerrillamail.com",
+	"guerrillamail.de",
+	"guerrillamail.info",
+	"guerrillamail.net",
+	"guerrillamail.org",
+	"guerrillamailblock.com",
+	"harakirimail.com",
+	"incognitomail.org",
+	"inboxbear.com",
+	"jetable.org",
+	"mailcatch.com",
+	"maildrop.cc",
+	"mailinator.com",
+	"mailinator.net",
+	"mailnesia.com",
+	"mailpoof.com",
+	"mintemail.com",
+	"mohmal.com",
+	"moakt.com",
+	"mytemp.email",
+	"nada.email",
+	"sharklasers.com",
+	"spam4.me",
+	"spambox.us",
+	"spamgourmet.com",
+	"temp-mail.io",
+	"temp-mail.org",
+	"tempail.com",
+	"tempinbox.com",
+	"tempmail.dev",
+	"tempmail.net",
+	"tempmailo.com",
+	"tempr.email",
+	"throwawaymail.com",
+	"trashmail.com",
+	"trashmail.de",
+	"trashmail.net",
+	"yopmail.com",
+	"yopmail.fr",
+	"yopmail.net",
+)
+
+func stringSet(ss ...string) map[string]bool {
+	m := make(map[string]bool, len(ss))
+	for _, s := range ss {
+		m[strings.ToLower(s)] = true
+	}
+	return m
+}
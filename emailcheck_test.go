@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+// fakeResolver answers lookups from maps. Names in neither map don't
+// exist.
+type fakeResolver struct {
+	mx      map[string][]*net.MX
+	hosts   map[string][]string
+	mxErr   map[string]error
+	hostErr map[string]error
+}
+
+func (f *fakeResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	if err := f.mxErr[name]; err != nil {
+		return nil, err
+	}
+	if mxs, ok := f.mx[name]; ok {
+		return mxs, nil
+	}
+	return nil, nxdomain(name)
+}
+
+func (f *fakeResolver) LookupHost(_ context.Context, name string) ([]string, error) {
+	if err := f.hostErr[name]; err != nil {
+		return nil, err
+	}
+	if hosts, ok := f.hosts[name]; ok {
+		return hosts, nil
+	}
+	return nil, nxdomain(name)
+}
+
+func nxdomain(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func servfail(name string) error {
+	return &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+}
+
+// withResolver swaps in r for the duration of the test
+func withResolver(t *testing.T, r resolver) {
+	old := dnsResolver
+	dnsResolver = r
+	t.Cleanup(func() { dnsResolver = old })
+}
+
+var testResolver = &fakeResolver{
+	mx: map[string][]*net.MX{
+		"example.com":     {{Host: "mx1.example.com.", Pref: 10}, {Host: "mx2.example.com.", Pref: 20}},
+		"nullmx.example":  {{Host: ".", Pref: 0}},
+		"emptymx.example": {{Host: "", Pref: 0}},
+	},
+	hosts: map[string][]string{
+		"a-only.example": {"192.0.2.1"},
+	},
+	mxErr: map[string]error{
+		"servfail.example":       servfail("servfail.example"),
+		"mx-gone-a-fail.example": nxdomain("mx-gone-a-fail.example"),
+	},
+	hostErr: map[string]error{
+		"mx-gone-a-fail.example": servfail("mx-gone-a-fail.example"),
+	},
+}
+
+func TestCheckMailDomain(t *testing.T) {
+	withResolver(t, testResolver)
+	tests := []struct {
+		domain string
+		ok     bool
+	}{
+		{"example.com", true},
+		{"a-only.example", true},         // no MX, falls back to the address record
+		{"nullmx.example", false},        // RFC 7505 null MX
+		{"emptymx.example", false},       // null MX as some resolvers return it
+		{"nxdomain.example", false},      // doesn't exist at all
+		{"servfail.example", true},       // DNS trouble isn't the address's fault
+		{"mx-gone-a-fail.example", true}, // nor is it when the fallback lookup fails
+	}
+	for _, tt := range tests {
+		err := checkMailDomain(context.Background(), tt.domain)
+		if (err == nil) != tt.ok {
+			t.Errorf("checkMailDomain(%q) = %v, want ok %v", tt.domain, err, tt.ok)
+		}
+	}
+}
+
+func TestCheckEmail(t *testing.T) {
+	withResolver(t, testResolver)
+	tests := []struct {
+		email      string
+		code       string
+		suspicious bool
+	}{
+		{"gopher@example.com", "", false},
+		{"gopher+tag@example.com", "", false},
+		{"", codeMalformedEmail, false},
+		{"gopher", codeMalformedEmail, false},
+		{"gopher@", codeMalformedEmail, false},
+		{"Go Pher <gopher@example.com>", codeMalformedEmail, false},
+		{"gopher@example.com, other@example.com", codeMalformedEmail, false},
+		{"gopher@localhost", codeMalformedEmail, false},
+		{"gopher@[192.0.2.1]", codeMalformedEmail, false},
+		{"gopher@mailinator.com", codeDisposableEmail, true},
+		{"gopher@MAILINATOR.COM", codeDisposableEmail, true},
+		{"gopher@nxdomain.example", codeUndeliverableEmail, true},
+		{"gopher@nullmx.example", codeUndeliverableEmail, true},
+		{"gopher@servfail.example", "", false},
+	}
+	for _, tt := range tests {
+		code, suspicious, err := checkEmail(context.Background(), tt.email)
+		if code != tt.code || suspicious != tt.suspicious {
+			t.Errorf("checkEmail(%q) = %q, %v, %v; want %q, %v", tt.email, code, suspicious, err, tt.code, tt.suspicious)
+		}
+		if (code == "") != (err == nil) {
+			t.Errorf("checkEmail(%q) returned code %q with error %v", tt.email, code, err)
+		}
+	}
+}
+
+func TestIsDisposable(t *testing.T) {
+	s := &settings{
+		DisposableDomains:        stringSet("throwaway.example"),
+		AllowedDisposableDomains: stringSet("33mail.com", "ok.yopmail.com"),
+	}
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"mailinator.com", true},      // built in
+		{"eu.mailinator.com", true},   // under a built in one
+		{"throwaway.example", true},   // added in the settings
+		{"x.throwaway.example", true}, // under an added one
+		{"33mail.com", false},         // taken off the built in list
+		{"me.33mail.com", false},      // and everything under it
+		{"ok.yopmail.com", false},     // allowed below a disposable domain
+		{"other.yopmail.com", true},   // but only that one
+		{"example.com", false},        // ordinary domains
+		{"notmailinator.com", false},  // suffixes only match whole labels
+		{"mailinator.com.example", false},
+	}
+	for _, tt := range tests {
+		if got := s.isDisposable(tt.domain); got != tt.want {
+			t.Errorf("isDisposable(%q) = %v, want %v", tt.domain, got, tt.want)
+		}
+	}
+}
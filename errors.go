@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// Stable error codes for failed invite requests
+const (
+	codeMissingEmail       = "missing_email"
+	codeMissingFirstName   = "missing_first_name"
+	codeMissingLastName    = "missing_last_name"
+	codeMissingCoC         = "missing_coc"
+	codeInvalidField       = "invalid_field"
+	codeDomainDenied       = "domain_denied"
+	codeInviteCodeInvalid  = "invite_code_invalid"
+	codeMalformedEmail     = "malformed_email"
+	codeDisposableEmail    = "disposable_email"
+	codeUndeliverableEmail = "undeliverable_email"
+	codeCaptchaError       = "captcha_error"
+	codeCaptchaInvalid     = "captcha_invalid"
+	codeCaptchaUnavailable = "captcha_unavailable"
+	codeBadRequest         = "bad_request"
+	codeTooManyRequests    = "too_many_requests"
+	codeInternalError      = "internal_error"
+	codeConfirmFailed      = "confirmation_failed"
+	codeConfirmExpired     = "confirmation_expired"
+	codeConfirmInvalid     = "confirmation_invalid"
+	codeFormExpired        = "form_expired"
+	codeBotDetected        = "bot_detected"
+
+	codeAlreadyInTeam  = "already_in_team"
+	codeAlreadyInvited = "already_invited"
+	codeDeactivated    = "account_deactivated"
+	codeInvalidEmail   = "invalid_email"
+	codeNotAllowed     = "not_allowed"
+	codeRateLimited    = "rate_limited"
+	codeSlackError     = "slack_error"
+)
+
+// codeStatus is the HTTP status returned for each code
+var codeStatus = map[string]int{
+	codeMissingEmail:       http.StatusPreconditionFailed,
+	codeMissingFirstName:   http.StatusPreconditionFailed,
+	codeMissingLastName:    http.StatusPreconditionFailed,
+	codeMissingCoC:         http.StatusPreconditionFailed,
+	codeInvalidField:       http.StatusPreconditionFailed,
+	codeDomainDenied:       http.StatusForbidden,
+	codeInviteCodeInvalid:  http.StatusForbidden,
+	codeMalformedEmail:     http.StatusBadRequest,
+	codeDisposableEmail:    http.StatusForbidden,
+	codeUndeliverableEmail: http.StatusBadRequest,
+	codeCaptchaError:       http.StatusPreconditionFailed,
+	codeCaptchaInvalid:     http.StatusForbidden,
+	codeCaptchaUnavailable: http.StatusServiceUnavailable,
+	codeBadRequest:         http.StatusBadRequest,
+	codeTooManyRequests:    http.StatusTooManyRequests,
+	codeInternalError:      http.StatusInternalServerError,
+	codeConfirmFailed:      http.StatusBadGateway,
+	codeConfirmExpired:     http.StatusGone,
+	codeConfirmInvalid:     http.StatusNotFound,
+	codeFormExpired:        http.StatusPreconditionFailed,
+	codeBotDetected:        http.StatusForbidden,
+	codeAlreadyInTeam:      http.StatusConflict,
+	codeAlreadyInvited:     http.StatusConflict,
+	codeDeactivated:        http.StatusForbidden,
+	codeInvalidEmail:       http.StatusBadRequest,
+	codeNotAllowed:         http.StatusForbidden,
+	codeRateLimited:        http.StatusServiceUnavailable,
+	codeSlackError:         http.StatusBadGateway,
+}
+
+// inviteError is a failed invite request. The code, and the message
+// looked up for it, are safe to show to the person asking for the invite.
+type inviteError struct {
+	Code       string
+	Status     int           // HTTP status
+	RetryAfter time.Duration // when it's worth trying again, if at all
+	Err        error         // what actually went wrong, for logs and the ledger
+	Field      string        // label of the form field at fault, if any
+}
+
+func (e *inviteError) Error() string {
+	if e.Err != nil {
+		return e.Code + ": " + e.Err.Error()
+	}
+	return e.Code
+}
+
+// Message returns the user facing text for the error in lang
+func (e *inviteError) Message(lang string) string {
+	return message(lang, e.Code, "{field}", e.Field)
+}
+
+// slackErrorCodes maps the error strings returned by slack's invite and
+// lookup APIs to our codes
+var slackErrorCodes = map[string]string{
+	"already_in_team":              codeAlreadyInTeam,
+	"already_invited":              codeAlreadyInvited,
+	"already_in_team_invited_user": codeAlreadyInvited,
+	"sent_recently":                codeAlreadyInvited,
+	"invalid_email":                codeInvalidEmail,
+	"bad_email":                    codeInvalidEmail,
+	"not_allowed":                  codeNotAllowed,
+	"restricted_action":            codeNotAllowed,
+	"user_disabled":                codeDeactivated,
+	"account_inactive":             codeDeactivated,
+	"ratelimited":                  codeRateLimited,
+}
+
+// the vendored admin API wraps errors with fmt.Errorf, which loses the
+// *slack.RateLimitedError, so fish the delay back out of the message
+var retryAfterRE = regexp.MustCompile(`retry after (\S+)`)
+
+// classifySlackError turns an error from the slack client into one of our
+// codes, with how long to wait before retrying if slack rate limited us
+func classifySlackError(err error) (string, time.Duration) {
+	if rle, ok := err.(*slack.RateLimitedError); ok {
+		return codeRateLimited, rle.RetryAfter
+	}
+	msg := err.Error()
+	if m := retryAfterRE.FindStringSubmatch(msg); m != nil {
+		d, _ := time.ParseDuration(m[1])
+		return codeRateLimited, d
+	}
+	if i := strings.LastIndex(msg, ": "); i >= 0 {
+		msg = msg[i+2:]
+	}
+	if code, ok := slackErrorCodes[strings.TrimSpace(msg)]; ok {
+		return code, 0
+	}
+	return codeSlackError, 0
+}
+
+// newInviteError builds the error for code. err may be nil.
+func newInviteError(code string, err error) *inviteError {
+	status, ok := codeStatus[code]
+	if !ok {
+		code, status = codeSlackError, http.StatusBadGateway
+	}
+	e := &inviteError{Code: code, Status: status, Err: err}
+	switch code {
+	case codeRateLimited, codeSlackError:
+		e.RetryAfter = time.Minute
+	case codeCaptchaUnavailable:
+		e.RetryAfter = c.CaptchaCooldown
+	}
+	return e
+}
+
+// countInviteError bumps the metric matching the error. Only errors that
+// aren't about the person's own account state count as invite errors.
+func countInviteError(e *inviteError) {
+	switch e.Code {
+	case codeAlreadyInTeam:
+		alreadyMember.Add(1)
+	case codeAlreadyInvited:
+		alreadyInvited.Add(1)
+	case codeDeactivated:
+		deactivatedAccount.Add(1)
+	default:
+		inviteErrors.Add(1)
+	}
+}
+
+// existingMember checks whether email already belongs to someone in the
+// team, returning the error to show them if so
+func existingMember(email string) *inviteError {
+	u, err := api.GetUserByEmail(email)
+	if err != nil {
+		if !strings.Contains(err.Error(), "users_not_found") {
+			// don't block invites because the token lacks users:read.email
+			log.Println("error looking up user by email:", err)
+		}
+		return nil
+	}
+	if u.Deleted {
+		return newInviteError(codeDeactivated, fmt.Errorf("user %s is deactivated", u.ID))
+	}
+	return newInviteError(codeAlreadyInTeam, fmt.Errorf("user %s already exists", u.ID))
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/nlopes/slack"
+)
+
+// Slack events we act on, whether they come from RTM or the Events API
+const (
+	eventTeamJoin       = "team_join"
+	eventUserChange     = "user_change"
+	eventPresenceChange = "presence_change" // RTM only
+	eventAppUninstalled = "app_uninstalled" // Events API only
+)
+
+// slackEvent is the part of a slack event subscribers care about
+type slackEvent struct {
+	Type     string
+	User     *slack.User // team_join and user_change
+	Users    []string    // presence_change
+	Presence string      // presence_change
+}
+
+var (
+	subscribersMu sync.RWMutex
+	subscribers   = make(map[string][]func(slackEvent))
+)
+
+// subscribe calls fn with every event of type typ
+func subscribe(typ string, fn func(slackEvent)) {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	subscribers[typ] = append(subscribers[typ], fn)
+}
+
+// dispatch hands ev to its subscribers
+func dispatch(ev slackEvent) {
+	subscribersMu.RLock()
+	fns := subscribers[ev.Type]
+	subscribersMu.RUnlock()
+	if len(fns) != 0 {
+		slackEvents.Add(1)
+	}
+	for _, fn := range fns {
+		fn(ev)
+	}
+}
+
+func init() {
+	subscribe(eventAppUninstalled, func(slackEvent) {
+		log.Println("the slack app was uninstalled, the token no longer works")
+		appUninstalled.Set(1)
+	})
+}
+
+// eventCallback is an Events API request body
+type eventCallback struct {
+	Type      string          `json:"type"` // url_verification or event_callback
+	Challenge string          `json:"challenge"`
+	TeamID    string          `json:"team_id"`
+	EventID   string          `json:"event_id"`
+	Event     json.RawMessage `json:"event"`
+}
+
+// handleSlackEvents receives the Events API. Requests have to be signed
+// with SigningSecret, without one the endpoint doesn't exist.
+func handleSlackEvents(w http.ResponseWriter, r *http.Request) {
+	if c.SigningSecret == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1024*1024))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	sv, err := slack.NewSecretsVerifier(r.Header, c.SigningSecret)
+	if err == nil {
+		sv.Write(body)
+		if sv.Ensure() != nil {
+			// Ensure's error includes the signature we expected, which
+			// would let anyone who reads the logs sign this body
+			err = errors.New("invalid signature")
+		}
+	}
+	if err != nil {
+		badEventSignatures.Add(1)
+		log.Println("rejected slack event:", err)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	var cb eventCallback
+	if err := json.Unmarshal(body, &cb); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	switch cb.Type {
+	case "url_verification":
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, cb.Challenge)
+		return
+	case "event_callback":
+	default:
+		// nothing else is sent to this endpoint, but don't make slack retry it
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if err := dispatchCallback(cb.Event); err != nil {
+		log.Printf("error decoding slack event %s: %v", cb.EventID, err)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// dispatchCallback decodes the inner event of an event_callback and
+// dispatches the ones we know
+func dispatchCallback(raw json.RawMessage) error {
+	var head struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(raw, &head); err != nil {
+		return err
+	}
+	switch head.Type {
+	case eventTeamJoin, eventUserChange:
+		var ev struct {
+			User slack.User `json:"user"`
+		}
+		if err := json.Unmarshal(raw, &ev); err != nil {
+			return err
+		}
+		dispatch(slackEvent{Type: head.Type, User: &ev.User})
+	case eventAppUninstalled:
+		dispatch(slackEvent{Type: head.Type})
+	}
+	return nil
+}
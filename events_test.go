@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slackRequest returns an Events API request for body, signed with secret
+// at ts
+func slackRequest(body, secret string, ts time.Time) *http.Request {
+	stamp := strconv.FormatInt(ts.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + stamp + ":" + body))
+	r := httptest.NewRequest("POST", "/slack/events", strings.NewReader(body))
+	r.Header.Set("X-Slack-Request-Timestamp", stamp)
+	r.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+	return r
+}
+
+func TestSlackEventsSignature(t *testing.T) {
+	withConfig(t, func(c *Specification) { c.SigningSecret = "secret" })
+	body := `{"type":"url_verification","challenge":"abc"}`
+	unsigned := httptest.NewRequest("POST", "/slack/events", strings.NewReader(body))
+	tampered := slackRequest(body, "secret", time.Now())
+	tampered.Body = io.NopCloser(strings.NewReader(strings.Replace(body, "abc", "xyz", 1)))
+	tests := []struct {
+		name string
+		r    *http.Request
+		want int
+	}{
+		{"signed", slackRequest(body, "secret", time.Now()), http.StatusOK},
+		{"unsigned", unsigned, http.StatusUnauthorized},
+		{"wrong secret", slackRequest(body, "guess", time.Now()), http.StatusUnauthorized},
+		{"replayed", slackRequest(body, "secret", time.Now().Add(-time.Hour)), http.StatusUnauthorized},
+		{"body changed", tampered, http.StatusUnauthorized},
+	}
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	for _, tt := range tests {
+		before := badEventSignatures.Value()
+		w := httptest.NewRecorder()
+		handleSlackEvents(w, tt.r)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+		if rejected := badEventSignatures.Value() > before; rejected != (tt.want == http.StatusUnauthorized) {
+			t.Errorf("%s: counted as a bad signature: %v", tt.name, rejected)
+		}
+		if tt.want == http.StatusOK && w.Body.String() != "abc" {
+			t.Errorf("%s: answered the challenge with %q", tt.name, w.Body.String())
+		}
+	}
+	// the expected signature for the changed body would let anyone who
+	// reads the logs send it
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("v0:" + tampered.Header.Get("X-Slack-Request-Timestamp") + ":" + strings.Replace(body, "abc", "xyz", 1)))
+	sum := mac.Sum(nil)
+	if strings.Contains(logs.String(), string(sum)) || strings.Contains(logs.String(), hex.EncodeToString(sum)) {
+		t.Errorf("the logs give away a valid signature: %q", logs.String())
+	}
+	if !strings.Contains(logs.String(), "invalid signature") {
+		t.Errorf("logs %q don't say why events were rejected", logs.String())
+	}
+}
+
+func TestSlackEventsWithoutSecret(t *testing.T) {
+	withConfig(t, func(c *Specification) { c.SigningSecret = "" })
+	w := httptest.NewRecorder()
+	handleSlackEvents(w, slackRequest(`{"type":"url_verification"}`, "", time.Now()))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status %d without a signing secret, want %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Form field types
+const (
+	fieldText     = "text"
+	fieldTextarea = "textarea"
+	fieldEmail    = "email"
+	fieldURL      = "url"
+	fieldNumber   = "number"
+	fieldSelect   = "select"
+	fieldCheckbox = "checkbox"
+)
+
+// maxFieldLength caps what people can put in an extra field
+const maxFieldLength = 500
+
+// formField is an extra question on the invite form, declared in the
+// settings file
+type formField struct {
+	Name        string   `json:"name"`
+	Type        string   `json:"type"`
+	Label       string   `json:"label"`
+	Placeholder string   `json:"placeholder"`
+	Required    bool     `json:"required"`
+	Pattern     string   `json:"pattern"` // regular expression the whole value must match
+	Options     []string `json:"options"` // for select fields
+
+	re *regexp.Regexp
+}
+
+var (
+	fieldNameRE = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+	// names the form already uses
+	reservedFieldNames = stringSet("email", "fname", "lname", "coc", "code", "page", "g-recaptcha-response", "form_token", honeypotField)
+)
+
+func (f *formField) validate() error {
+	if !fieldNameRE.MatchString(f.Name) || reservedFieldNames[f.Name] {
+		return fmt.Errorf("invalid field name %q", f.Name)
+	}
+	switch f.Type {
+	case fieldText, fieldTextarea, fieldEmail, fieldURL, fieldNumber, fieldCheckbox:
+	case fieldSelect:
+		if len(f.Options) == 0 {
+			return fmt.Errorf("select field %q has no options", f.Name)
+		}
+	default:
+		return fmt.Errorf("field %q has unknown type %q", f.Name, f.Type)
+	}
+	if f.Label == "" {
+		f.Label = f.Name
+	}
+	if f.Pattern != "" {
+		re, err := regexp.Compile(`^(?:` + f.Pattern + `)$`)
+		if err != nil {
+			return fmt.Errorf("field %q: %v", f.Name, err)
+		}
+		f.re = re
+	}
+	return nil
+}
+
+// check validates a submitted value, returning it cleaned up
+func (f *formField) check(v string) (string, bool) {
+	v = strings.TrimSpace(v)
+	if f.Type == fieldCheckbox {
+		if v == "1" || v == "true" || v == "on" {
+			v = "yes"
+		} else {
+			v = ""
+		}
+	}
+	if v == "" {
+		return "", !f.Required
+	}
+	if utf8.RuneCountInString(v) > maxFieldLength {
+		return "", false
+	}
+	switch f.Type {
+	case fieldEmail:
+		if _, err := mail.ParseAddress(v); err != nil {
+			return "", false
+		}
+	case fieldURL:
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "", false
+		}
+	case fieldNumber:
+		if _, err := strconv.ParseFloat(v, 64); err != nil {
+			return "", false
+		}
+	case fieldSelect:
+		ok := false
+		for _, o := range f.Options {
+			if v == o {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return "", false
+		}
+	}
+	if f.re != nil && !f.re.MatchString(v) {
+		return "", false
+	}
+	return v, true
+}
+
+// checkFields validates the extra fields in values, returning the cleaned
+// up values to store, or the first field that isn't right
+func (s *settings) checkFields(values map[string]string) (map[string]string, *formField) {
+	var out map[string]string
+	for i := range s.Fields {
+		f := &s.Fields[i]
+		v, ok := f.check(values[f.Name])
+		if !ok {
+			return nil, f
+		}
+		if v == "" {
+			continue
+		}
+		if out == nil {
+			out = make(map[string]string)
+		}
+		out[f.Name] = v
+	}
+	return out, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bot check policies, for requests that trip the honeypot or the form
+// timing checks
+const (
+	botCheckReject = "reject"
+	botCheckFlag   = "flag" // send them to the moderators instead
+	botCheckOff    = "off"
+)
+
+// honeypotField is a form field hidden from people. Anything in it was put
+// there by a bot.
+const honeypotField = "website"
+
+// Problems checkFormToken finds
+const (
+	formHoneypot = "honeypot"
+	formTooFast  = "too_fast"
+	formExpired  = "expired"
+	formReused   = "reused"
+	formInvalid  = "invalid"
+)
+
+var (
+	formKey    []byte
+	formNonces = newNonceCache()
+)
+
+// setupFormTokens sets the key form tokens are signed with. Without a
+// secret, which is only allowed while the checks are off, a random one is
+// used.
+func setupFormTokens(secret string) {
+	formKey = []byte(secret)
+	if len(formKey) == 0 {
+		formKey = make([]byte, 32)
+		if _, err := rand.Read(formKey); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// newFormToken returns a signed token recording when the form was
+// rendered: nonce.unixmillis.mac
+func newFormToken() string {
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	payload := fmt.Sprintf("%x.%d", nonce, time.Now().UnixNano()/int64(time.Millisecond))
+	return payload + "." + signForm(payload)
+}
+
+func signForm(payload string) string {
+	mac := hmac.New(sha256.New, formKey)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkFormToken looks for signs that a bot filled in the form. It returns
+// the problem found, if any, and the token's nonce and expiry so the
+// caller can spend it once the request is accepted.
+func checkFormToken(token, honeypot string) (problem, nonce string, expires time.Time) {
+	if honeypot != "" {
+		return formHoneypot, "", time.Time{}
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || !hmac.Equal([]byte(parts[2]), []byte(signForm(parts[0]+"."+parts[1]))) {
+		return formInvalid, "", time.Time{}
+	}
+	ms, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return formInvalid, "", time.Time{}
+	}
+	rendered := time.Unix(0, ms*int64(time.Millisecond))
+	nonce, expires = parts[0], rendered.Add(c.FormTokenTTL)
+	switch age := time.Since(rendered); {
+	case age < c.MinFormTime:
+		return formTooFast, nonce, expires
+	case age > c.FormTokenTTL:
+		return formExpired, nonce, expires
+	}
+	if formNonces.seen(nonce) {
+		return formReused, nonce, expires
+	}
+	return "", nonce, expires
+}
+
+func countFormProblem(problem string) {
+	switch problem {
+	case formHoneypot:
+		honeypotFilled.Add(1)
+	case formTooFast:
+		formTooFastCount.Add(1)
+	case formExpired:
+		formTokenExpired.Add(1)
+	case formReused:
+		formTokenReused.Add(1)
+	case formInvalid:
+		formTokenInvalid.Add(1)
+	}
+}
+
+// nonceCache remembers single use nonces until they expire
+type nonceCache struct {
+	mu sync.Mutex
+	m  map[string]time.Time
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{m: make(map[string]time.Time)}
+}
+
+// seen reports whether nonce has been used
+func (n *nonceCache) seen(nonce string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, ok := n.m[nonce]
+	return ok
+}
+
+// use marks nonce as spent until expires, reporting false if it already was
+func (n *nonceCache) use(nonce string, expires time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := time.Now()
+	for k, exp := range n.m {
+		if now.After(exp) {
+			delete(n.m, k)
+		}
+	}
+	if _, ok := n.m[nonce]; ok {
+		return false
+	}
+	n.m[nonce] = expires
+	return true
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// withFormKey signs form tokens with a fixed key for the test
+func withFormKey(t *testing.T) {
+	old := formKey
+	setupFormTokens("secret")
+	t.Cleanup(func() { formKey = old })
+}
+
+// formTokenAt builds a form token for a page rendered at t
+func formTokenAt(nonce string, t time.Time) string {
+	payload := fmt.Sprintf("%s.%d", nonce, t.UnixNano()/int64(time.Millisecond))
+	return payload + "." + signForm(payload)
+}
+
+func TestCheckFormToken(t *testing.T) {
+	withFormKey(t)
+	withConfig(t, func(c *Specification) {
+		c.MinFormTime = 3 * time.Second
+		c.FormTokenTTL = 2 * time.Hour
+	})
+	minuteAgo := time.Now().Add(-time.Minute)
+	tests := []struct {
+		name     string
+		token    string
+		honeypot string
+		want     string
+	}{
+		{"good", formTokenAt("a1", minuteAgo), "", ""},
+		{"honeypot", formTokenAt("a2", minuteAgo), "http://spam.example", formHoneypot},
+		{"too fast", formTokenAt("a3", time.Now()), "", formTooFast},
+		{"expired", formTokenAt("a4", time.Now().Add(-3*time.Hour)), "", formExpired},
+		{"bad mac", formTokenAt("a5", minuteAgo) + "00", "", formInvalid},
+		{"malformed", "a6", "", formInvalid},
+	}
+	for _, tt := range tests {
+		if problem, _, _ := checkFormToken(tt.token, tt.honeypot); problem != tt.want {
+			t.Errorf("%s: problem %q, want %q", tt.name, problem, tt.want)
+		}
+	}
+}
+
+func TestFormTokenReuse(t *testing.T) {
+	withFormKey(t)
+	withConfig(t, func(c *Specification) {
+		c.MinFormTime = 0
+		c.FormTokenTTL = 2 * time.Hour
+	})
+	token := newFormToken()
+	problem, nonce, expires := checkFormToken(token, "")
+	if problem != "" {
+		t.Fatalf("a new token has problem %q", problem)
+	}
+	// nothing is spent until the request is accepted
+	if problem, _, _ := checkFormToken(token, ""); problem != "" {
+		t.Fatalf("a token checked twice before use has problem %q", problem)
+	}
+	if !formNonces.use(nonce, expires) {
+		t.Fatal("a new token was already spent")
+	}
+	if problem, _, _ := checkFormToken(token, ""); problem != formReused {
+		t.Errorf("a spent token has problem %q, want %q", problem, formReused)
+	}
+	if formNonces.use(nonce, expires) {
+		t.Error("a token was spent twice")
+	}
+}
+
+func TestNonceCacheForgetsExpired(t *testing.T) {
+	n := newNonceCache()
+	n.use("old", time.Now().Add(-time.Second))
+	n.use("new", time.Now().Add(time.Hour))
+	if n.seen("old") {
+		t.Error("an expired nonce is still remembered")
+	}
+	if !n.seen("new") {
+		t.Error("a live nonce was forgotten")
+	}
+}
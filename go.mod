@@ -3,7 +3,6 @@ module github.com/flexd/slackinviter
 go 1.12
 
 require (
-	github.com/go-recaptcha/recaptcha v1.0.1
 	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0
 	github.com/gorilla/handlers v0.0.0-20160410185317-66e6c6f01d8d
 	github.com/gorilla/websocket v0.0.0-20180420171612-21ab95fa12b9
@@ -12,7 +11,6 @@ require (
 	github.com/nlopes/slack v0.5.0
 	github.com/paulbellamy/ratecounter v0.1.0
 	github.com/pkg/errors v0.0.0-20190109061628-ffb6e22f0193
-	github.com/pquerna/ffjson v0.0.0-20160407231528-7327d038fae6
 	golang.org/x/image v0.0.0-20181116024801-cd38e8056d9b
 	golang.org/x/net v0.0.0-20160421003651-815d315ead42
 )
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// check is the result of one readiness check
+type check struct {
+	OK     bool   `json:"ok"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func pass(format string, args ...interface{}) check {
+	return check{OK: true, Reason: fmt.Sprintf(format, args...)}
+}
+
+func fail(format string, args ...interface{}) check {
+	return check{Reason: fmt.Sprintf(format, args...)}
+}
+
+// handleHealthz says the process is up and serving requests
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	io.WriteString(w, "ok\n")
+}
+
+// handleReadyz checks what we need to do our job and answers 503 if
+// anything is wrong. The reasons name the Slack user and team and pass on
+// Slack's errors, so only the admin gets them.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	checks := map[string]check{
+		"slack_token": checkSlackToken(ctx),
+		"slack_poll":  checkSlackPoll(),
+		"captcha":     checkCaptcha(),
+		"templates":   checkTemplates(),
+		"store":       checkStore(),
+	}
+	status, code := "ok", http.StatusOK
+	admin := isAdmin(r)
+	for name, ch := range checks {
+		if !ch.OK {
+			status, code = "fail", http.StatusServiceUnavailable
+		}
+		if !admin {
+			checks[name] = check{OK: ch.OK}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Status string           `json:"status"`
+		Checks map[string]check `json:"checks"`
+	}{status, checks})
+}
+
+// auth.test results are cached so probes don't eat into slack's rate limit
+var authCheck struct {
+	sync.Mutex
+	result check
+	at     time.Time
+}
+
+const authCheckTTL = time.Minute
+
+func checkSlackToken(ctx context.Context) check {
+	authCheck.Lock()
+	defer authCheck.Unlock()
+	if time.Since(authCheck.at) < authCheckTTL {
+		return authCheck.result
+	}
+	resp, err := api.AuthTestContext(ctx)
+	if err != nil {
+		authCheck.result = fail("auth.test: %v", err)
+	} else {
+		authCheck.result = pass("authenticated as %s on %s", resp.User, resp.Team)
+	}
+	authCheck.at = time.Now()
+	return authCheck.result
+}
+
+func checkSlackPoll() check {
+	last := lastPollSuccess.Value()
+	if last == 0 {
+		if ourTeam.Domain() != "" {
+			return pass("waiting for the first scan, using the snapshot")
+		}
+		return fail("no successful poll yet")
+	}
+	age := time.Since(time.Unix(last, 0)).Round(time.Second)
+	// a scan is due every hour, or every ReconcileInterval while RTM
+	// keeps the counts current
+	max := 2 * time.Hour
+	if rtmCurrent() && 2*c.ReconcileInterval > max {
+		max = 2 * c.ReconcileInterval
+	}
+	if age > max {
+		if e := lastPollError.Value(); e != "" {
+			return fail("last successful poll %s ago, last error: %s", age, e)
+		}
+		return fail("last successful poll %s ago", age)
+	}
+	return pass("last successful poll %s ago", age)
+}
+
+func checkCaptcha() check {
+	st := captchaBreakerStatus()
+	if st == nil {
+		return pass("%s needs no third party", captcha.Widget().Provider)
+	}
+	if st.State != breakerOpen {
+		return pass("circuit breaker %s", st.State)
+	}
+	if c.CaptchaDegraded != degradedReject {
+		return pass("provider unavailable since %s, degraded to %s", st.OpenedAt.Format(time.RFC3339), c.CaptchaDegraded)
+	}
+	return fail("provider unavailable since %s", st.OpenedAt.Format(time.RFC3339))
+}
+
+// the last rendering error of each page, cleared by its next success
+var renderStatus = struct {
+	sync.Mutex
+	errs map[string]error
+}{errs: make(map[string]error)}
+
+// renderResult records how rendering the named page went
+func renderResult(name string, err error) {
+	renderStatus.Lock()
+	defer renderStatus.Unlock()
+	if err == nil {
+		delete(renderStatus.errs, name)
+		return
+	}
+	renderStatus.errs[name] = err
+}
+
+// checkTemplates reports on rendering; the templates themselves are parsed
+// at startup, which fails if they don't load
+func checkTemplates() check {
+	renderStatus.Lock()
+	defer renderStatus.Unlock()
+	names := make([]string, 0, len(renderStatus.errs))
+	for name := range renderStatus.errs {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return pass("loaded and rendering")
+	}
+	sort.Strings(names)
+	return fail("last render of %s failed: %v", strings.Join(names, ", "), renderStatus.errs[names[0]])
+}
+
+func checkStore() check {
+	if err := invites.Ping(); err != nil {
+		return fail("invite ledger: %v", err)
+	}
+	return pass("invite ledger ok")
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRenderStatusPerPage(t *testing.T) {
+	t.Cleanup(func() {
+		renderResult("admin", nil)
+		renderResult("index", nil)
+	})
+	renderResult("admin", errors.New("template: admin.tmpl: boom"))
+	// a good render of another page doesn't hide the broken one
+	renderResult("index", nil)
+	if ch := checkTemplates(); ch.OK {
+		t.Fatal("templates pass while the admin page fails to render")
+	}
+	renderResult("admin", nil)
+	if ch := checkTemplates(); !ch.OK {
+		t.Fatalf("templates still fail once every page renders: %s", ch.Reason)
+	}
+}
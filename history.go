@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// historyPoint is the member counts at one point in time
+type historyPoint struct {
+	Time time.Time `json:"time"`
+	memberCounts
+}
+
+// Older history is thinned out to one point per historyTiers step
+var historyTiers = []struct {
+	age, step time.Duration
+}{
+	{30 * 24 * time.Hour, 24 * time.Hour},
+	{2 * 24 * time.Hour, time.Hour},
+}
+
+// historyStore is a time series of member counts, kept in memory and in an
+// append only JSON lines file that's rewritten when old points are thinned
+// out
+type historyStore struct {
+	path     string
+	interval time.Duration // least time between points from live updates
+
+	mu          sync.Mutex
+	f           *os.File
+	points      []historyPoint // oldest first
+	lastCompact time.Time
+}
+
+var history = new(historyStore)
+
+// openHistory loads the history at path, keeping it in memory only if
+// path is empty
+func openHistory(path string, interval time.Duration) (*historyStore, error) {
+	h := &historyStore{path: path, interval: interval}
+	if path == "" {
+		return h, nil
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var p historyPoint
+		if err := json.Unmarshal(sc.Bytes(), &p); err != nil {
+			continue // a torn final write
+		}
+		h.points = append(h.points, p)
+	}
+	if err := sc.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	sort.Slice(h.points, func(i, j int) bool { return h.points[i].Time.Before(h.points[j].Time) })
+	h.f = f
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.compactLocked(time.Now()); err != nil {
+		h.f.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// record adds a point unless, for updates that aren't forced, the last one
+// is recent or the same
+func (h *historyStore) record(n memberCounts, force bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now().UTC()
+	if k := len(h.points); k > 0 && !force {
+		last := h.points[k-1]
+		if last.memberCounts == n || now.Sub(last.Time) < h.interval {
+			return
+		}
+	}
+	p := historyPoint{Time: now, memberCounts: n}
+	h.points = append(h.points, p)
+	if h.f != nil {
+		b, err := json.Marshal(p)
+		if err == nil {
+			_, err = h.f.Write(append(b, '\n'))
+		}
+		if err != nil {
+			log.Println("error writing history:", err)
+		}
+	}
+	if now.Sub(h.lastCompact) > 24*time.Hour {
+		if err := h.compactLocked(now); err != nil {
+			log.Println("error compacting history:", err)
+		}
+	}
+}
+
+// compactLocked thins out old points and rewrites the file. h.mu must be
+// held.
+func (h *historyStore) compactLocked(now time.Time) error {
+	h.lastCompact = now
+	var out []historyPoint
+	rest := h.points
+	for _, tier := range historyTiers {
+		cut := now.Add(-tier.age)
+		i := 0
+		for i < len(rest) && rest[i].Time.Before(cut) {
+			i++
+		}
+		out = append(out, downsample(rest[:i], tier.step)...)
+		rest = rest[i:]
+	}
+	out = append(out, rest...)
+	if len(out) == len(h.points) {
+		return nil
+	}
+	h.points = out
+	if h.f == nil {
+		return nil
+	}
+
+	tmp := h.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, p := range out {
+		if err := enc.Encode(p); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, h.path); err != nil {
+		return err
+	}
+	nf, err := os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	h.f.Close()
+	h.f = nf
+	return nil
+}
+
+// query returns the points in [from, to), downsampled to one per step if
+// step is set
+func (h *historyStore) query(from, to time.Time, step time.Duration) []historyPoint {
+	h.mu.Lock()
+	var out []historyPoint
+	for _, p := range h.points {
+		if !p.Time.Before(from) && p.Time.Before(to) {
+			out = append(out, p)
+		}
+	}
+	h.mu.Unlock()
+	if step > 0 {
+		out = downsample(out, step)
+	}
+	return out
+}
+
+func (h *historyStore) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.f == nil {
+		return nil
+	}
+	return h.f.Close()
+}
+
+// downsample keeps the last point in each step long bucket
+func downsample(points []historyPoint, step time.Duration) []historyPoint {
+	var out []historyPoint
+	for i, p := range points {
+		if i+1 < len(points) && points[i+1].Time.Truncate(step).Equal(p.Time.Truncate(step)) {
+			continue
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
+// handleHistory serves the member count history as JSON, or as CSV with
+// format=csv or an Accept header asking for text/csv. from and to are
+// RFC 3339 times or unix seconds, step a Go duration such as 24h.
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	if handleCORS(w, r, "GET") {
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	to, err := parseHistoryTime(q.Get("to"), time.Now().UTC())
+	if err != nil {
+		http.Error(w, "bad to: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, err := parseHistoryTime(q.Get("from"), to.Add(-30*24*time.Hour))
+	if err != nil {
+		http.Error(w, "bad from: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var step time.Duration
+	if s := q.Get("step"); s != "" {
+		if step, err = time.ParseDuration(s); err != nil || step < 0 {
+			http.Error(w, "bad step", http.StatusBadRequest)
+			return
+		}
+	}
+	points := history.query(from, to, step)
+
+	if q.Get("format") == "csv" || (q.Get("format") == "" && strings.Contains(r.Header.Get("Accept"), "text/csv")) {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"time", "total", "active", "guests", "deleted"})
+		for _, p := range points {
+			cw.Write([]string{
+				p.Time.Format(time.RFC3339),
+				strconv.FormatInt(p.Total, 10),
+				strconv.FormatInt(p.Active, 10),
+				strconv.FormatInt(p.Guests, 10),
+				strconv.FormatInt(p.Deleted, 10),
+			})
+		}
+		cw.Flush()
+		return
+	}
+	if points == nil {
+		points = []historyPoint{}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(struct {
+		From   time.Time      `json:"from"`
+		To     time.Time      `json:"to"`
+		Step   int64          `json:"step,omitempty"` // seconds
+		Points []historyPoint `json:"points"`
+	}{from, to, int64(step / time.Second), points})
+}
+
+func parseHistoryTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Results of an invite request that didn't fail
+const (
+	resultInvited = "invited"
+	resultPending = "pending"
+	resultQueued  = "queued"
+	resultConfirm = "confirm" // check your email for the confirmation link
+)
+
+// inviteRequest is someone asking for an invite, however they submitted it
+type inviteRequest struct {
+	Email     string `json:"email"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	CoC       bool   `json:"coc"`
+	Captcha   string `json:"captcha"`
+	// CaptchaProvider is the widget Captcha came from, as the page or
+	// /api/v1/challenge named it. Empty means the configured provider.
+	CaptchaProvider string `json:"captcha_provider"`
+	// Page is the path of the page the form was on, used to pick a profile
+	Page string `json:"page"`
+	// Code is an optional admin issued invite code
+	Code string `json:"code"`
+	// Fields has the answers to the extra form fields by name
+	Fields map[string]string `json:"fields"`
+	// FormToken is the signed token the form was rendered with, Website
+	// the honeypot people can't see
+	FormToken string `json:"form_token"`
+	Website   string `json:"website"`
+
+	remoteIP string
+	lang     string
+}
+
+// processInvite validates req and either invites the person or queues the
+// request for moderation, returning resultInvited or resultPending
+func processInvite(ctx context.Context, req *inviteRequest) (string, *inviteError) {
+	successfulCaptcha.Add(1)
+	// everything that passes goes in the ledger
+	if ie := checkLengths(req); ie != nil {
+		return "", ie
+	}
+	st := getSettings()
+	rec := &inviteRecord{
+		ID:        newID(),
+		Time:      time.Now().UTC(),
+		Email:     req.Email,
+		FirstName: req.FirstName,
+		LastName:  req.LastName,
+		IP:        req.remoteIP,
+		Outcome:   outcomeRejected,
+		Profile:   st.profileFor(req.Email, req.Page),
+	}
+	var ic inviteCode
+	if req.Code != "" {
+		var ok bool
+		if ic, ok = codes.lookup(req.Code); ok {
+			rec.InviteCode = ic.Code
+			if ic.Profile != "" {
+				rec.Profile = ic.Profile
+			}
+		}
+	}
+	// rate limited requests are left out of the ledger, there's no end to
+	// them
+	if ie := checkRateLimits(req.remoteIP, rec.InviteCode != ""); ie != nil {
+		return "", ie
+	}
+	limited := false
+	defer func() {
+		if !limited {
+			recordInvite(rec)
+		}
+	}()
+	reject := func(code string, err error) (string, *inviteError) {
+		ie := newInviteError(code, err)
+		rec.Code = ie.Code
+		if err != nil {
+			rec.Error = err.Error()
+		}
+		return "", ie
+	}
+
+	var formNonce string
+	var formExpires time.Time
+	if c.BotCheck != botCheckOff {
+		var problem string
+		problem, formNonce, formExpires = checkFormToken(req.FormToken, req.Website)
+		if problem != "" {
+			countFormProblem(problem)
+			if c.BotCheck == botCheckReject {
+				if problem == formExpired {
+					return reject(codeFormExpired, nil)
+				}
+				return reject(codeBotDetected, fmt.Errorf("form check: %s", problem))
+			}
+			rec.Flags = append(rec.Flags, "form_"+problem)
+			rec.Moderate = true
+			if problem == formReused {
+				formNonce = "" // already flagged
+			}
+		}
+	}
+	if req.Email == "" {
+		missingEmail.Add(1)
+		return reject(codeMissingEmail, nil)
+	}
+	if req.FirstName == "" {
+		missingFirstName.Add(1)
+		return reject(codeMissingFirstName, nil)
+	}
+	if req.LastName == "" {
+		missingLastName.Add(1)
+		return reject(codeMissingLastName, nil)
+	}
+	if !req.CoC {
+		missingCoC.Add(1)
+		return reject(codeMissingCoC, nil)
+	}
+	fields, bad := st.checkFields(req.Fields)
+	if bad != nil {
+		invalidField.Add(1)
+		_, ie := reject(codeInvalidField, fmt.Errorf("invalid value for field %s", bad.Name))
+		ie.Field = bad.Label
+		return "", ie
+	}
+	rec.Fields = fields
+	if req.Code != "" && rec.InviteCode == "" {
+		invalidInviteCode.Add(1)
+		return reject(codeInviteCodeInvalid, nil)
+	}
+	action := st.domainAction(req.Email)
+	if action == policyDeny {
+		deniedDomain.Add(1)
+		return reject(codeDomainDenied, nil)
+	}
+	// moderation the policy asks for, which an invite code can waive;
+	// the flags below always hold a request for a moderator
+	byPolicy := action == policyModerate || (c.Moderate && action != policyApprove)
+	if code, suspicious, err := checkEmail(ctx, req.Email); code != "" {
+		countEmailCheck(code)
+		if !suspicious || c.SuspiciousEmail != suspiciousModerate {
+			return reject(code, err)
+		}
+		rec.Flags = append(rec.Flags, code)
+		rec.Moderate = true
+	}
+	if ic.SkipCaptcha {
+		rec.Captcha = "skipped: invite code"
+	} else {
+		res, err := verifyCaptcha(ctx, req.CaptchaProvider, req.Captcha, req.remoteIP)
+		if _, unavailable := err.(*unavailableError); unavailable {
+			if c.CaptchaDegraded != degradedModerate {
+				failedCaptcha.Add(1)
+				return reject(codeCaptchaUnavailable, fmt.Errorf("captcha: %v", err))
+			}
+			captchaDegraded.Add(1)
+			rec.Captcha = "unavailable"
+			rec.Flags = append(rec.Flags, "captcha_unavailable")
+			rec.Moderate = true
+		} else if err != nil {
+			failedCaptcha.Add(1)
+			return reject(codeCaptchaError, fmt.Errorf("captcha: %v", err))
+		} else {
+			if res.HasScore {
+				score := res.Score
+				rec.CaptchaScore = &score
+			}
+			rec.RiskAction = riskAction(res)
+			switch rec.RiskAction {
+			case riskReject:
+				invalidCaptcha.Add(1)
+				rec.Captcha = describeCaptcha("invalid", res)
+				return reject(codeCaptchaInvalid, nil)
+			case riskModerate:
+				rec.Flags = append(rec.Flags, "low_captcha_score")
+				rec.Moderate = true
+			}
+			rec.Captcha = describeCaptcha("valid", res)
+		}
+	}
+	if ie := checkEmailLimit(req.Email); ie != nil {
+		limited = true
+		return "", ie
+	}
+	if ie := existingMember(req.Email); ie != nil {
+		countInviteError(ie)
+		rec.Code = ie.Code
+		rec.Error = ie.Err.Error()
+		return "", ie
+	}
+	if byPolicy && !ic.SkipModeration {
+		rec.Moderate = true
+	}
+	if formNonce != "" && !formNonces.use(formNonce, formExpires) {
+		formTokenReused.Add(1)
+		if c.BotCheck == botCheckReject {
+			return reject(codeBotDetected, fmt.Errorf("form check: %s", formReused))
+		}
+		rec.Flags = append(rec.Flags, "form_"+formReused)
+		rec.Moderate = true
+	}
+	if rec.InviteCode != "" {
+		if err := codes.redeem(rec.InviteCode, rec); err != nil {
+			invalidInviteCode.Add(1)
+			return reject(codeInviteCodeInvalid, err)
+		}
+		redeemedInviteCodes.Add(1)
+	}
+	if c.ConfirmEmail {
+		if err := sendConfirmation(rec, req.lang); err != nil {
+			log.Println("error sending confirmation email:", err)
+			return reject(codeConfirmFailed, err)
+		}
+		confirmationsSent.Add(1)
+		rec.Outcome = outcomeUnconfirmed
+		return resultConfirm, nil
+	}
+	return dispatchInvite(rec)
+}
+
+// dispatchInvite moves an accepted request on to the moderators, the
+// delivery queue or slack
+func dispatchInvite(rec *inviteRecord) (string, *inviteError) {
+	if rec.Moderate {
+		rec.Outcome = outcomePending
+		queuedInvites.Add(1)
+		return resultPending, nil
+	}
+	// all is well, let's try to invite someone!
+	if c.AsyncInvites {
+		rec.Outcome = outcomeQueued
+		return resultQueued, nil
+	}
+	if ie := sendInvite(rec); ie != nil {
+		return "", ie
+	}
+	return resultInvited, nil
+}
+
+// Longest names and email address taken. No real name comes close, and no
+// address can be longer.
+const (
+	maxNameLength  = 200
+	maxEmailLength = 254
+)
+
+// checkLengths turns away requests with names or an email address too long
+// to be real
+func checkLengths(req *inviteRequest) *inviteError {
+	if len(req.Email) > maxEmailLength {
+		countEmailCheck(codeMalformedEmail)
+		return newInviteError(codeMalformedEmail, errors.New("email address too long"))
+	}
+	for _, f := range []struct{ label, value string }{
+		{"First name", req.FirstName},
+		{"Last name", req.LastName},
+	} {
+		if len(f.value) > maxNameLength {
+			invalidField.Add(1)
+			ie := newInviteError(codeInvalidField, fmt.Errorf("%s too long", strings.ToLower(f.label)))
+			ie.Field = f.label
+			return ie
+		}
+	}
+	return nil
+}
+
+// handleInvite takes the invite form as a form post and answers in plain
+// text. New clients should use /api/v1/invite.
+func handleInvite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 64*1024)
+	provider := r.FormValue("captcha_provider")
+	req := &inviteRequest{
+		Email:           r.FormValue("email"),
+		FirstName:       r.FormValue("fname"),
+		LastName:        r.FormValue("lname"),
+		CoC:             r.FormValue("coc") == "1",
+		Captcha:         r.FormValue(captchaResponseField(provider)),
+		CaptchaProvider: provider,
+		Page:            r.FormValue("page"),
+		Code:            r.FormValue("code"),
+		FormToken:       r.FormValue("form_token"),
+		Website:         r.FormValue(honeypotField),
+		remoteIP:        clientIP(r),
+		lang:            requestLang(r),
+	}
+	for _, f := range getSettings().Fields {
+		if v := r.FormValue(f.Name); v != "" {
+			if req.Fields == nil {
+				req.Fields = make(map[string]string)
+			}
+			req.Fields[f.Name] = v
+		}
+	}
+	if req.Page == "" {
+		if ref, err := url.Parse(r.Referer()); err == nil {
+			req.Page = ref.Path
+		}
+	}
+	lang := req.lang
+	result, ie := processInvite(r.Context(), req)
+	if ie != nil {
+		setRetryAfter(w, ie)
+		http.Error(w, ie.Message(lang), ie.Status)
+		return
+	}
+	if result != resultInvited {
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprint(w, message(lang, result))
+	}
+}
+
+// apiResponse is the body of every /api/v1/invite response
+type apiResponse struct {
+	Status     string `json:"status"` // invited, pending, queued, confirm or error
+	Code       string `json:"code,omitempty"`
+	Message    string `json:"message"`
+	RetryAfter int    `json:"retry_after,omitempty"` // seconds
+}
+
+// handleAPIInvite takes an inviteRequest as JSON and answers with an
+// apiResponse
+func handleAPIInvite(w http.ResponseWriter, r *http.Request) {
+	if handleCORS(w, r, "POST") {
+		return
+	}
+	lang := requestLang(r)
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeAPIError(w, lang, &inviteError{Code: codeBadRequest, Status: http.StatusMethodNotAllowed})
+		return
+	}
+	req := new(inviteRequest)
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024))
+	if err := dec.Decode(req); err != nil {
+		writeAPIError(w, lang, newInviteError(codeBadRequest, err))
+		return
+	}
+	req.remoteIP = clientIP(r)
+	req.lang = lang
+
+	result, ie := processInvite(r.Context(), req)
+	if ie != nil {
+		writeAPIError(w, lang, ie)
+		return
+	}
+	status := http.StatusOK
+	if result != resultInvited {
+		status = http.StatusAccepted
+	}
+	writeAPI(w, status, apiResponse{Status: result, Message: message(lang, result)})
+}
+
+func writeAPIError(w http.ResponseWriter, lang string, ie *inviteError) {
+	resp := apiResponse{
+		Status:  "error",
+		Code:    ie.Code,
+		Message: ie.Message(lang),
+	}
+	resp.RetryAfter = setRetryAfter(w, ie)
+	writeAPI(w, ie.Status, resp)
+}
+
+// setRetryAfter sets the Retry-After header if ie has a retry hint,
+// returning the number of seconds
+func setRetryAfter(w http.ResponseWriter, ie *inviteError) int {
+	if ie.RetryAfter <= 0 {
+		return 0
+	}
+	secs := int((ie.RetryAfter + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	return secs
+}
+
+func writeAPI(w http.ResponseWriter, status int, resp apiResponse) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println("error writing api response:", err)
+	}
+}
+
+// handleAPIChallenge hands API clients a fresh challenge for providers
+// that need one
+func handleAPIChallenge(w http.ResponseWriter, r *http.Request) {
+	if handleCORS(w, r, "GET") {
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	wdg := captchaWidgetWithChallenge()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(struct {
+		Provider  string `json:"provider"`
+		Challenge string `json:"challenge,omitempty"`
+		FormToken string `json:"form_token"`
+	}{wdg.Provider, wdg.Challenge, newFormToken()})
+}
+
+// handleCORS lets the sites in AllowedOrigins call the API from the
+// browser. It answers preflight requests itself, reporting whether r was
+// one.
+func handleCORS(w http.ResponseWriter, r *http.Request, method string) bool {
+	origin := r.Header.Get("Origin")
+	allowed := origin != "" && originAllowed(origin)
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	if allowed {
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Set("Access-Control-Expose-Headers", "Retry-After")
+	}
+	if r.Method != "OPTIONS" {
+		return false
+	}
+	if !allowed {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return true
+	}
+	h.Set("Access-Control-Allow-Methods", method)
+	h.Set("Access-Control-Allow-Headers", "Content-Type, Accept-Language")
+	h.Set("Access-Control-Max-Age", "86400")
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+func originAllowed(origin string) bool {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" || strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendInvite asks slack to invite the person in rec and records the outcome
+// on it
+func sendInvite(rec *inviteRecord) *inviteError {
+	p, err := getSettings().profile(rec.Profile)
+	if err == nil {
+		teamName := ourTeam.Domain()
+		switch p.Type {
+		case profileMultiChannelGuest:
+			err = api.InviteRestricted(teamName, strings.Join(p.Channels, ","), rec.FirstName, rec.LastName, rec.Email)
+		case profileSingleChannelGuest:
+			err = api.InviteGuest(teamName, p.Channels[0], rec.FirstName, rec.LastName, rec.Email)
+		default:
+			err = api.InviteToTeam(teamName, rec.FirstName, rec.LastName, rec.Email)
+		}
+	}
+	if err != nil {
+		log.Println("invite error:", err)
+		code, retryAfter := classifySlackError(err)
+		ie := newInviteError(code, err)
+		if retryAfter > 0 {
+			ie.RetryAfter = retryAfter
+		}
+		countInviteError(ie)
+		rec.Outcome = outcomeFailed
+		rec.Code = ie.Code
+		rec.Error = err.Error()
+		return ie
+	}
+	rec.Outcome = outcomeInvited
+	rec.Code = ""
+	rec.Error = ""
+	successfulInvites.Add(1)
+	return nil
+}
+
+// recordInvite writes rec to the ledger and, once it's there, hands queued
+// invites to the delivery queue
+func recordInvite(rec *inviteRecord) {
+	logInvite(rec)
+	if rec.Outcome != outcomeQueued {
+		return
+	}
+	if err := deliveries.add(*rec); err != nil {
+		log.Println("error queueing invite:", err)
+		rec.Outcome = outcomeFailed
+		rec.Code = codeInternalError
+		rec.Error = err.Error()
+		logInvite(rec)
+	}
+}
+
+// logInvite writes the attempt to the invite ledger
+func logInvite(rec *inviteRecord) {
+	if err := invites.Put(*rec); err != nil {
+		log.Println("error writing invite ledger:", err)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// lifecycle runs the background workers and the HTTP server, and when the
+// process is told to stop, shuts them down in order: first the server,
+// letting requests in flight (invites included) finish, then the workers,
+// then whatever needs writing to disk.
+type lifecycle struct {
+	ctx    context.Context // done once the server has drained
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newLifecycle() *lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &lifecycle{ctx: ctx, cancel: cancel}
+}
+
+// run starts fn as a background worker. fn must return once ctx is done.
+func (l *lifecycle) run(fn func(ctx context.Context)) {
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		fn(l.ctx)
+	}()
+}
+
+// serve runs srv until the process gets SIGTERM or SIGINT, then shuts
+// everything down within c.ShutdownTimeout
+func (l *lifecycle) serve(srv *http.Server) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-errc:
+		l.cancel()
+		return err
+	case s := <-sig:
+		log.Printf("got %s, shutting down", s)
+	}
+	signal.Stop(sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.ShutdownTimeout)
+	defer cancel()
+	// stopped is cleared when something may still be writing to the
+	// stores, which then have to stay open
+	stopped := true
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("error draining requests:", err)
+		stopped = false
+	}
+
+	l.cancel()
+	done := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Println("background workers didn't stop in time")
+		stopped = false
+	}
+
+	flush()
+	if stopped {
+		closeStores()
+	} else {
+		log.Println("leaving the stores open for work still running")
+	}
+	log.Println("shut down")
+	return nil
+}
+
+// flush writes out everything kept in memory. It's safe while requests
+// and workers are still running.
+func flush() {
+	if err := deliveries.flush(); err != nil {
+		log.Println("error saving delivery queue:", err)
+	}
+	if !stale() {
+		if err := saveSnapshot(c.SnapshotPath); err != nil {
+			log.Println("error saving snapshot:", err)
+		}
+	}
+}
+
+// closeStores closes the stores once nothing is using them. Every record
+// is written as it's made, so this loses nothing if it's skipped.
+func closeStores() {
+	if err := history.Close(); err != nil {
+		log.Println("error closing history:", err)
+	}
+	if err := invites.Close(); err != nil {
+		log.Println("error closing invite ledger:", err)
+	}
+}
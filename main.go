@@ -5,15 +5,12 @@ import (
 	"context"
 	"expvar"
 	"flag"
-	"fmt"
 	"log"
-	"net"
 	"net/http"
 	"os"
 	"text/template"
 	"time"
 
-	"github.com/go-recaptcha/recaptcha"
 	"github.com/gorilla/handlers"
 	"github.com/kelseyhightower/envconfig"
 	badge "github.com/narqo/go-badge"
@@ -25,10 +22,13 @@ var indexTemplate = template.Must(template.New("index.tmpl").ParseFiles("templat
 
 var (
 	api     *slack.Client
-	captcha *recaptcha.Recaptcha
+	captcha captchaProvider
 	counter *ratecounter.RateCounter
 
-	ourTeam = new(team)
+	ourTeam    = new(team)
+	invites    inviteStore
+	codes      *codeStore
+	deliveries *deliveryQueue
 
 	m *expvar.Map
 	hitsPerMinute,
@@ -42,27 +42,156 @@ var (
 	failedCaptcha,
 	invalidCaptcha,
 	successfulInvites,
+	queuedInvites,
+	deniedDomain,
+	alreadyMember,
+	alreadyInvited,
+	deactivatedAccount,
+	deliveryQueueDepth,
+	deliveryRetries,
+	deadLetters,
+	rateLimitedIP,
+	rateLimitedPrefix,
+	rateLimitedEmail,
+	malformedEmail,
+	disposableEmail,
+	undeliverableEmail,
+	confirmationsSent,
+	confirmationsCompleted,
+	confirmationsExpired,
+	invalidInviteCode,
+	redeemedInviteCodes,
+	invalidField,
+	scoreInvite,
+	scoreModerate,
+	scoreReject,
+	honeypotFilled,
+	formTooFastCount,
+	formTokenExpired,
+	formTokenReused,
+	formTokenInvalid,
+	captchaBreakerTrips,
+	captchaUnavailable,
+	captchaDegraded,
+	rtmConnected,
+	presenceSubscribed,
+	presenceLeftOut,
+	lastPresenceEvent,
+	slackEvents,
+	badEventSignatures,
+	appUninstalled,
+	lastPollSuccess,
+	lastPollErrorTime,
+	pollDuration,
 	userCount,
-	activeUserCount expvar.Int
+	activeUserCount,
+	memberCount,
+	multiChannelGuestCount,
+	singleChannelGuestCount,
+	appUserCount,
+	ownerCount,
+	adminCount,
+	guestCount,
+	deletedUserCount expvar.Int
 )
 
+var lastPollError expvar.String
+
 var c Specification
 
 // Specification is the config struct
 type Specification struct {
-	Port           string `envconfig:"PORT" required:"true"`
-	CaptchaSitekey string `required:"true"`
-	CaptchaSecret  string `required:"true"`
-	SlackToken     string `required:"true"`
-	CocUrl         string `required:"false" default:"http://coc.golangbridge.org/"`
-	EnforceHTTPS   bool
-	Debug          bool   // toggles nlopes/slack client's debug flag
-	Maintenance    bool   `required:"false"`
-	SupportEmail   string `required:"false" default:"support@gobridge.org"`
-	InviteLink     string
+	Port            string `envconfig:"PORT" required:"true"`
+	CaptchaProvider string `required:"false" default:"recaptcha"` // recaptcha, recaptcha_v3, hcaptcha, turnstile, pow or none
+	CaptchaSitekey  string `required:"false"`
+	CaptchaSecret   string `required:"false"`
+	// for providers that score responses, like reCAPTCHA v3: scores at or
+	// above ScoreInvite are invited, at or above ScoreModerate moderated and
+	// lower ones rejected
+	ScoreInvite   float64 `required:"false" default:"0.7"`
+	ScoreModerate float64 `required:"false" default:"0.3"`
+	// leading zero bits the pow captcha asks for, rising with the hit rate
+	PoWDifficulty    int `required:"false" default:"16"`
+	PoWMaxDifficulty int `required:"false" default:"20"`
+	// how long to wait for the captcha provider, and how many failures in a
+	// row make us stop asking it for CaptchaCooldown
+	CaptchaTimeout  time.Duration `required:"false" default:"5s"`
+	CaptchaFailures int           `required:"false" default:"5"`
+	CaptchaCooldown time.Duration `required:"false" default:"30s"`
+	// what to do while the provider is unavailable: reject, moderate or pow
+	CaptchaDegraded string `required:"false" default:"reject"`
+	SlackToken      string `required:"true"`
+	CocUrl          string `required:"false" default:"http://coc.golangbridge.org/"`
+	EnforceHTTPS    bool
+	Debug           bool   // toggles nlopes/slack client's debug flag
+	Maintenance     bool   `required:"false"`
+	SupportEmail    string `required:"false" default:"support@gobridge.org"`
+	InviteLink      string
+	StorePath       string `required:"false" default:"invites.jsonl"` // invite ledger file
+	Moderate        bool   // queue invites for review instead of sending them
+	AdminUser       string `required:"false" default:"admin"`
+	AdminPassword   string `required:"false"` // the admin pages are disabled when empty
+	SettingsFile    string `required:"false"` // JSON file with invite profiles and rules
+	AsyncInvites    bool   // send invites from a background queue
+	QueuePath       string `required:"false" default:"queue.json"`
+	CodesPath       string `required:"false" default:"codes.json"` // admin issued invite codes
+	QueueWorkers    int    `required:"false" default:"2"`
+	QueueAttempts   int    `required:"false" default:"8"` // before an invite becomes a dead letter
+	TrustProxy      bool   // take the client IP from X-Forwarded-For, e.g. on Heroku
+	NoProxy         bool   // clients connect to us directly, so the client IP is the peer's
+	// invite requests allowed per hour, 0 for no limit. The per IP and per
+	// network limits need TrustProxy or NoProxy.
+	IPRateLimit     int `required:"false" default:"0"`
+	PrefixRateLimit int `required:"false" default:"0"` // per /24 or /64
+	EmailRateLimit  int `required:"false" default:"3"`
+	// what to do with disposable or undeliverable addresses: reject or moderate
+	SuspiciousEmail string `required:"false" default:"reject"`
+	// double opt-in: email a confirmation link before inviting
+	ConfirmEmail  bool
+	ConfirmSecret string        `required:"false"` // signs confirmation links
+	ConfirmTTL    time.Duration `required:"false" default:"24h"`
+	PublicURL     string        `required:"false"` // base URL for links, e.g. https://invite.example.com
+	SMTPHost      string        `required:"false" default:"localhost"`
+	SMTPPort      int           `required:"false" default:"25"`
+	SMTPUser      string        `required:"false"`
+	SMTPPassword  string        `required:"false"`
+	SMTPFrom      string        `required:"false"`
+	// how long sending a confirmation email may take, connecting included
+	SMTPTimeout time.Duration `required:"false" default:"10s"`
+	// honeypot and form timing checks: reject, flag (moderate) or off
+	BotCheck     string        `required:"false" default:"off"`
+	FormSecret   string        `required:"false"` // signs form tokens, needed unless BotCheck is off
+	MinFormTime  time.Duration `required:"false" default:"3s"`
+	FormTokenTTL time.Duration `required:"false" default:"2h"`
+	// keep member counts current from the RTM websocket, rescanning the
+	// whole user list every ReconcileInterval to correct drift
+	LiveCounts        bool          `required:"false" default:"true"`
+	ReconcileInterval time.Duration `required:"false" default:"6h"`
+	// the app's signing secret, /slack/events is disabled when empty
+	SigningSecret string `required:"false"`
+	// last known team info and counts, shown until the first scan is done
+	SnapshotPath string `required:"false" default:"snapshot.json"`
+	// member count history, with a point at most every HistoryInterval
+	// between full scans
+	HistoryPath     string        `required:"false" default:"history.jsonl"`
+	HistoryInterval time.Duration `required:"false" default:"15m"`
+	// how long to wait for requests and background work to finish on
+	// SIGTERM; Heroku kills the dyno 30s after sending it
+	ShutdownTimeout time.Duration `required:"false" default:"25s"`
+	// sites, like https://example.com, that may call the API from the
+	// browser; * allows any
+	AllowedOrigins []string `required:"false"`
+	// how long the invite ledger keeps rejected requests, 0 for ever
+	KeepRejected time.Duration `required:"false" default:"720h"`
+	// how long a call to the slack API may take, shorter than
+	// ShutdownTimeout so an invite in flight can't hold up a shutdown
+	SlackTimeout time.Duration `required:"false" default:"10s"`
 }
 
-func init() {
+// setup reads the configuration and opens everything the server needs. It
+// runs from main rather than init so that tests can load the package
+// without a configuration.
+func setup() {
 	showUsage := flag.Bool("h", false, "Show usage")
 	flag.Parse()
 
@@ -91,11 +220,136 @@ func init() {
 	m.Set("invalid_captcha", &invalidCaptcha)
 	m.Set("successful_captcha", &successfulCaptcha)
 	m.Set("successful_invites", &successfulInvites)
+	m.Set("queued_invites", &queuedInvites)
+	m.Set("denied_domain", &deniedDomain)
+	m.Set("already_member", &alreadyMember)
+	m.Set("already_invited", &alreadyInvited)
+	m.Set("deactivated_account", &deactivatedAccount)
+	m.Set("delivery_queue_depth", &deliveryQueueDepth)
+	m.Set("delivery_retries", &deliveryRetries)
+	m.Set("dead_letters", &deadLetters)
+	m.Set("rate_limited_ip", &rateLimitedIP)
+	m.Set("rate_limited_prefix", &rateLimitedPrefix)
+	m.Set("rate_limited_email", &rateLimitedEmail)
+	m.Set("malformed_email", &malformedEmail)
+	m.Set("disposable_email", &disposableEmail)
+	m.Set("undeliverable_email", &undeliverableEmail)
+	m.Set("confirmations_sent", &confirmationsSent)
+	m.Set("confirmations_completed", &confirmationsCompleted)
+	m.Set("confirmations_expired", &confirmationsExpired)
+	m.Set("invalid_invite_code", &invalidInviteCode)
+	m.Set("redeemed_invite_codes", &redeemedInviteCodes)
+	m.Set("invalid_field", &invalidField)
+	m.Set("captcha_score_invite", &scoreInvite)
+	m.Set("captcha_score_moderate", &scoreModerate)
+	m.Set("captcha_score_reject", &scoreReject)
+	m.Set("honeypot_filled", &honeypotFilled)
+	m.Set("form_too_fast", &formTooFastCount)
+	m.Set("form_token_expired", &formTokenExpired)
+	m.Set("form_token_reused", &formTokenReused)
+	m.Set("form_token_invalid", &formTokenInvalid)
+	m.Set("captcha_breaker_trips", &captchaBreakerTrips)
+	m.Set("captcha_unavailable", &captchaUnavailable)
+	m.Set("captcha_degraded", &captchaDegraded)
+	m.Set("rtm_connected", &rtmConnected)
+	m.Set("rtm_presence_subscribed", &presenceSubscribed)
+	m.Set("rtm_presence_left_out", &presenceLeftOut)
+	m.Set("rtm_last_presence_event", &lastPresenceEvent)
+	m.Set("slack_events", &slackEvents)
+	m.Set("bad_event_signatures", &badEventSignatures)
+	m.Set("slack_app_uninstalled", &appUninstalled)
+	m.Set("slack_poll_last_success", &lastPollSuccess)
+	m.Set("slack_poll_last_error", &lastPollError)
+	m.Set("slack_poll_last_error_time", &lastPollErrorTime)
+	m.Set("slack_poll_duration_ms", &pollDuration)
+	m.Set("counts_stale", expvar.Func(func() interface{} { return stale() }))
+	m.Set("captcha_breaker", expvar.Func(func() interface{} { return captchaBreakerStatus() }))
 	m.Set("active_user_count", &activeUserCount)
 	m.Set("user_count", &userCount)
+	m.Set("member_count", &memberCount)
+	m.Set("multi_channel_guest_count", &multiChannelGuestCount)
+	m.Set("single_channel_guest_count", &singleChannelGuestCount)
+	m.Set("app_user_count", &appUserCount)
+	m.Set("owner_count", &ownerCount)
+	m.Set("admin_count", &adminCount)
+	m.Set("guest_count", &guestCount)
+	m.Set("deleted_user_count", &deletedUserCount)
 
-	captcha = recaptcha.New(c.CaptchaSecret)
-	api = slack.New(c.SlackToken, slack.OptionDebug(c.Debug))
+	s, err := loadSettings(c.SettingsFile)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	currentSettings.Store(s)
+	members.setRules(s.Counting)
+	invites, err = openFileStore(c.StorePath, c.KeepRejected)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if err := recoverInterrupted(); err != nil {
+		log.Fatal(err.Error())
+	}
+	if c.ScoreModerate > c.ScoreInvite {
+		log.Fatal("ScoreModerate can't be higher than ScoreInvite")
+	}
+	if c.SuspiciousEmail != suspiciousReject && c.SuspiciousEmail != suspiciousModerate {
+		log.Fatalf("SuspiciousEmail must be %q or %q", suspiciousReject, suspiciousModerate)
+	}
+	if c.ConfirmEmail && (c.ConfirmSecret == "" || c.SMTPFrom == "" || c.PublicURL == "") {
+		// links can't be built from the Host header, which the client
+		// chooses
+		log.Fatal("ConfirmEmail needs ConfirmSecret, SMTPFrom and PublicURL")
+	}
+	switch c.BotCheck {
+	case botCheckReject, botCheckFlag, botCheckOff:
+	default:
+		log.Fatalf("BotCheck must be %q, %q or %q", botCheckReject, botCheckFlag, botCheckOff)
+	}
+	if c.BotCheck != botCheckOff && c.FormSecret == "" {
+		// a random key would turn every form away after a restart, or
+		// when the next request lands on another dyno
+		log.Fatal("BotCheck needs FormSecret, or set it to off")
+	}
+	setupFormTokens(c.FormSecret)
+	switch c.CaptchaDegraded {
+	case degradedReject, degradedModerate, degradedPoW:
+	default:
+		log.Fatalf("CaptchaDegraded must be %q, %q or %q", degradedReject, degradedModerate, degradedPoW)
+	}
+	if c.TrustProxy && c.NoProxy {
+		log.Fatal("TrustProxy and NoProxy can't both be set")
+	}
+	if (c.IPRateLimit > 0 || c.PrefixRateLimit > 0) && !c.TrustProxy && !c.NoProxy {
+		// behind a proxy every client would share the proxy's bucket
+		log.Fatal("IPRateLimit and PrefixRateLimit need TrustProxy, or NoProxy if clients connect directly")
+	}
+	ipLimiter = newLimiter(c.IPRateLimit)
+	prefixLimiter = newLimiter(c.PrefixRateLimit)
+	emailLimiter = newLimiter(c.EmailRateLimit)
+	codes, err = openCodeStore(c.CodesPath)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	deliveries, err = openDeliveryQueue(c.QueuePath, c.QueueAttempts)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	captcha, err = newCaptchaProvider(c.CaptchaProvider, c.CaptchaSitekey, c.CaptchaSecret)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if c.SlackTimeout <= 0 || c.SlackTimeout >= c.ShutdownTimeout {
+		// a slack call in flight has to end in time for the shutdown
+		c.SlackTimeout = c.ShutdownTimeout / 2
+		log.Println("SlackTimeout must be shorter than ShutdownTimeout, using", c.SlackTimeout)
+	}
+	api = slack.New(c.SlackToken,
+		slack.OptionDebug(c.Debug),
+		slack.OptionHTTPClient(&http.Client{Timeout: c.SlackTimeout}))
+	loadSnapshot(c.SnapshotPath)
+	history, err = openHistory(c.HistoryPath, c.HistoryInterval)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
 }
 
 func handleBadge(w http.ResponseWriter, r *http.Request) {
@@ -110,23 +364,57 @@ func handleBadge(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var buf bytes.Buffer
-	if err := badge.Render("slack", users, "#E01563", &buf); err != nil {
-		log.Fatal(err)
+	err := badge.Render("slack", users, "#E01563", &buf)
+	renderResult("badge", err)
+	if err != nil {
+		log.Println("error rendering badge:", err)
+		http.Error(w, "error rendering badge :-(", http.StatusInternalServerError)
+		return
 	}
 	w.Header().Set("Content-Type", "image/svg+xml; charset=utf-8")
 	buf.WriteTo(w)
 }
 
 func main() {
-	go pollSlack()
+	setup()
+	lc := newLifecycle()
+	lc.run(pollSlack)
+	if c.LiveCounts {
+		lc.run(watchSlack)
+	}
+	go reloadOnHUP()
+	if c.AsyncInvites {
+		lc.run(func(ctx context.Context) { deliveries.run(ctx, c.QueueWorkers) })
+	}
 	mux := http.NewServeMux()
 	mux.HandleFunc("/invite/", handleInvite)
+	mux.HandleFunc("/api/v1/invite", handleAPIInvite)
+	mux.HandleFunc("/api/v1/challenge", handleAPIChallenge)
+	mux.HandleFunc("/api/v1/stats/history", handleHistory)
+	mux.HandleFunc("/confirm/", handleConfirm)
+	mux.HandleFunc("/slack/events", handleSlackEvents)
 	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("./static"))))
 	mux.HandleFunc("/", enforceHTTPSFunc(homepage))
 	mux.HandleFunc("/badge.svg", handleBadge)
+	mux.HandleFunc("/admin/", requireAdmin(handleAdmin))
+	mux.HandleFunc("/admin/approve", requireAdmin(handleApprove))
+	mux.HandleFunc("/admin/deny", requireAdmin(handleDeny))
+	mux.HandleFunc("/admin/retry", requireAdmin(handleRetry))
+	mux.HandleFunc("/admin/reload", requireAdmin(handleReload))
+	mux.HandleFunc("/admin/replay", requireAdmin(handleReplay))
+	mux.HandleFunc("/admin/codes", requireAdmin(handleCreateCode))
 	mux.Handle("/debug/vars", http.DefaultServeMux)
-	err := http.ListenAndServe(":"+c.Port, handlers.CombinedLoggingHandler(os.Stdout, mux))
-	if err != nil {
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+	srv := &http.Server{
+		Addr:              ":" + c.Port,
+		Handler:           handlers.CombinedLoggingHandler(os.Stdout, mux),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      time.Minute, // room for the captcha check and the invite
+		IdleTimeout:       2 * time.Minute,
+	}
+	if err := lc.serve(srv); err != nil {
 		log.Fatal(err.Error())
 	}
 }
@@ -146,79 +434,25 @@ func enforceHTTPSFunc(h http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-// Updates the globals from the slack API
-// returns the length of time to sleep before the function
-// should be called again
-func updateFromSlack() time.Duration {
-	var (
-		err            error
-		p              slack.UserPagination
-		uCount, aCount int64 // users and active users
-	)
-
-	ctx := context.Background()
-
-	// load team info first as it's much faster than paginating user count
-	st, err := api.GetTeamInfo()
-	if err != nil {
-		log.Println("error polling slack for team info:", err)
-		return time.Minute
-	}
-	ourTeam.Update(st)
-
-	for p = api.GetUsersPaginated(
-		slack.GetUsersOptionPresence(true),
-		slack.GetUsersOptionLimit(500),
-	); !p.Done(err); p, err = p.Next(ctx) {
-		if err != nil {
-			if rle, ok := err.(*slack.RateLimitedError); ok {
-				fmt.Printf("Being Rate Limited by Slack: %s\n", rle)
-				// XXX(theckman): hotfix: not be working as expected
-				// time.Sleep(rle.RetryAfter)
-				time.Sleep(3020 * time.Millisecond)
-				continue
-			}
-		}
-		for _, u := range p.Users {
-			if u.ID != "USLACKBOT" && !u.IsBot && !u.Deleted {
-				uCount++
-				if u.Presence == "active" {
-					aCount++
-				}
-			}
-		}
-		fmt.Println("User Count:", uCount)
-		fmt.Println("Active Count:", aCount)
-	}
-
-	userCount.Set(uCount)
-	activeUserCount.Set(aCount)
-	if err != nil && !p.Done(err) {
-		log.Println("error polling slack for users:", err)
-		return time.Minute
-	}
-
-	return time.Hour
-}
-
-// pollSlack over and over again
-func pollSlack() {
-	for {
-		time.Sleep(updateFromSlack())
-	}
-}
-
 // Homepage renders the homepage
 func homepage(w http.ResponseWriter, r *http.Request) {
 	counter.Incr(1)
 	hitsPerMinute.Set(counter.Rate())
 	requests.Add(1)
 
+	// only valid codes make it into the page, they're ours so they're safe
+	// to render
+	code, _ := codes.lookup(r.FormValue("code"))
+	var asOf time.Time
+	if stale() {
+		asOf = countsAsOf
+	}
+
 	var buf bytes.Buffer
 	err := indexTemplate.Execute(
 		&buf,
 		struct {
-			SiteKey,
+			Captcha captchaWidget
 			UserCount,
 			ActiveCount string
 			Team            *team
@@ -226,8 +460,14 @@ func homepage(w http.ResponseWriter, r *http.Request) {
 			MaintenanceMode bool
 			SupportEmail    string
 			InviteLink      string
+			InviteCode      inviteCode
+			Fields          []formField
+			FormToken       string
+			Honeypot        string
+			CountsAsOf      time.Time // set while the counts come from a snapshot
+			Counts          map[string]string
 		}{
-			c.CaptchaSitekey,
+			captchaWidgetWithChallenge(),
 			userCount.String(),
 			activeUserCount.String(),
 			ourTeam,
@@ -235,8 +475,15 @@ func homepage(w http.ResponseWriter, r *http.Request) {
 			c.Maintenance,
 			c.SupportEmail,
 			c.InviteLink,
+			code,
+			getSettings().Fields,
+			newFormToken(),
+			honeypotField,
+			asOf,
+			memberCountVars(),
 		},
 	)
+	renderResult("index", err)
 	if err != nil {
 		log.Println("error rendering template:", err)
 		http.Error(w, "error rendering template :-(", http.StatusInternalServerError)
@@ -246,65 +493,3 @@ func homepage(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	buf.WriteTo(w)
 }
-
-// ShowPost renders a single post
-func handleInvite(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
-		return
-	}
-	successfulCaptcha.Add(1)
-	fname := r.FormValue("fname")
-	lname := r.FormValue("lname")
-	email := r.FormValue("email")
-	coc := r.FormValue("coc")
-	if email == "" {
-		missingEmail.Add(1)
-		http.Error(w, "Missing email", http.StatusPreconditionFailed)
-		return
-	}
-	if fname == "" {
-		missingFirstName.Add(1)
-		http.Error(w, "Missing first name", http.StatusPreconditionFailed)
-		return
-	}
-	if lname == "" {
-		missingLastName.Add(1)
-		http.Error(w, "Missing last name", http.StatusPreconditionFailed)
-		return
-	}
-	if coc != "1" {
-		missingCoC.Add(1)
-		http.Error(w, "You need to accept the code of conduct", http.StatusPreconditionFailed)
-		return
-	}
-	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		failedCaptcha.Add(1)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
-	}
-
-	captchaResponse := r.FormValue("g-recaptcha-response")
-	valid, err := captcha.Verify(captchaResponse, remoteIP)
-	if err != nil {
-		failedCaptcha.Add(1)
-		http.Error(w, "Error validating recaptcha.. Did you click it?", http.StatusPreconditionFailed)
-		return
-	}
-	if !valid {
-		invalidCaptcha.Add(1)
-		http.Error(w, "Invalid recaptcha", http.StatusInternalServerError)
-		return
-
-	}
-	// all is well, let's try to invite someone!
-	err = api.InviteToTeam(ourTeam.Domain(), fname, lname, email)
-	if err != nil {
-		log.Println("InviteToTeam error:", err)
-		inviteErrors.Add(1)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	successfulInvites.Add(1)
-}
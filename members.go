@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// Member categories. Every user that isn't a bot is in exactly one, the
+// first that applies.
+const (
+	categorySingleChannelGuest = "single_channel_guests"
+	categoryMultiChannelGuest  = "multi_channel_guests"
+	categoryAppUser            = "app_users"
+	categoryOwner              = "owners"
+	categoryAdmin              = "admins"
+	categoryMember             = "members"
+)
+
+// categoryCounts are the metrics for each category
+var categoryCounts = map[string]*expvar.Int{
+	categorySingleChannelGuest: &singleChannelGuestCount,
+	categoryMultiChannelGuest:  &multiChannelGuestCount,
+	categoryAppUser:            &appUserCount,
+	categoryOwner:              &ownerCount,
+	categoryAdmin:              &adminCount,
+	categoryMember:             &memberCount,
+}
+
+// memberInfo is what we need to know about a user to count them
+type memberInfo struct {
+	Bot      bool
+	Deleted  bool
+	Active   bool
+	Category string
+}
+
+func memberInfoFor(u *slack.User) memberInfo {
+	mi := memberInfo{
+		Bot:     u.IsBot,
+		Deleted: u.Deleted,
+		Active:  u.Presence == "active",
+	}
+	switch {
+	case u.IsUltraRestricted:
+		mi.Category = categorySingleChannelGuest
+	case u.IsRestricted:
+		mi.Category = categoryMultiChannelGuest
+	case u.IsAppUser:
+		mi.Category = categoryAppUser
+	case u.IsOwner || u.IsPrimaryOwner:
+		mi.Category = categoryOwner
+	case u.IsAdmin:
+		mi.Category = categoryAdmin
+	default:
+		mi.Category = categoryMember
+	}
+	return mi
+}
+
+func (mi memberInfo) guest() bool {
+	return mi.Category == categorySingleChannelGuest || mi.Category == categoryMultiChannelGuest
+}
+
+// countingRules decide who counts towards the member total. The zero value
+// counts everyone but bots and deleted accounts.
+type countingRules struct {
+	ExcludeMultiChannelGuests  bool     `json:"exclude_multi_channel_guests"`
+	ExcludeSingleChannelGuests bool     `json:"exclude_single_channel_guests"`
+	ExcludeAppUsers            bool     `json:"exclude_app_users"`
+	ExcludeOwners              bool     `json:"exclude_owners"`
+	ExcludeAdmins              bool     `json:"exclude_admins"`
+	ExcludeUsers               []string `json:"exclude_users"` // IDs of users never counted
+
+	excluded map[string]bool
+}
+
+func (r *countingRules) validate() {
+	r.excluded = make(map[string]bool, len(r.ExcludeUsers))
+	for _, id := range r.ExcludeUsers {
+		r.excluded[id] = true
+	}
+}
+
+// ignored reports whether the user is left out of every count
+func (r countingRules) ignored(id string, mi memberInfo) bool {
+	return id == "USLACKBOT" || mi.Bot || r.excluded[id]
+}
+
+// counted reports whether the user counts towards the member total
+func (r countingRules) counted(id string, mi memberInfo) bool {
+	if r.ignored(id, mi) || mi.Deleted {
+		return false
+	}
+	switch mi.Category {
+	case categoryMultiChannelGuest:
+		return !r.ExcludeMultiChannelGuests
+	case categorySingleChannelGuest:
+		return !r.ExcludeSingleChannelGuests
+	case categoryAppUser:
+		return !r.ExcludeAppUsers
+	case categoryOwner:
+		return !r.ExcludeOwners
+	case categoryAdmin:
+		return !r.ExcludeAdmins
+	}
+	return true
+}
+
+// memberCounts are the tallies the tracker publishes
+type memberCounts struct {
+	Total   int64 `json:"total"`
+	Active  int64 `json:"active"`
+	Guests  int64 `json:"guests"`
+	Deleted int64 `json:"deleted"`
+}
+
+// memberTracker keeps the member counts current. A full scan of the user
+// list replaces everything it knows, RTM events then adjust it one user at
+// a time.
+type memberTracker struct {
+	mu         sync.Mutex
+	users      map[string]memberInfo
+	rules      countingRules
+	counts     memberCounts
+	categories map[string]int64
+	// scanned is set by the first full scan. Until then the tracker only
+	// knows the users events mention, and publishing counts made from them
+	// would replace the ones restored from the snapshot.
+	scanned  bool
+	synced   chan struct{} // closed after the first full scan
+	syncOnce sync.Once
+}
+
+var members = newMemberTracker()
+
+func init() {
+	update := func(ev slackEvent) { members.update(ev.User) }
+	subscribe(eventTeamJoin, update)
+	subscribe(eventUserChange, update)
+	subscribe(eventPresenceChange, func(ev slackEvent) { members.setPresence(ev.Users, ev.Presence) })
+}
+
+func newMemberTracker() *memberTracker {
+	return &memberTracker{
+		users:      make(map[string]memberInfo),
+		categories: make(map[string]int64),
+		synced:     make(chan struct{}),
+	}
+}
+
+// replace swaps in the result of a full scan
+func (t *memberTracker) replace(users map[string]memberInfo) {
+	t.mu.Lock()
+	t.users = users
+	t.scanned = true
+	t.recountLocked()
+	history.record(t.counts, true)
+	t.mu.Unlock()
+	t.syncOnce.Do(func() { close(t.synced) })
+}
+
+// setRules changes who counts towards the total
+func (t *memberTracker) setRules(r countingRules) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rules = r
+	if t.scanned {
+		t.recountLocked()
+	}
+}
+
+func (t *memberTracker) recountLocked() {
+	t.counts = memberCounts{}
+	t.categories = make(map[string]int64)
+	for id, mi := range t.users {
+		t.addLocked(id, mi, 1)
+	}
+	t.publishLocked()
+}
+
+// update applies a team_join or user_change event. Those don't say
+// whether the user is online, so the last known presence is kept. Events
+// before the first scan are dropped, the scan will see their users, and
+// neither counts nor history should be made from a handful of them.
+func (t *memberTracker) update(u *slack.User) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.scanned {
+		return
+	}
+	mi := memberInfoFor(u)
+	if old, ok := t.users[u.ID]; ok {
+		mi.Active = old.Active
+		t.addLocked(u.ID, old, -1)
+	}
+	t.users[u.ID] = mi
+	t.addLocked(u.ID, mi, 1)
+	t.publishLocked()
+	history.record(t.counts, false)
+}
+
+// setPresence applies a presence_change event
+func (t *memberTracker) setPresence(ids []string, presence string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.scanned {
+		return
+	}
+	for _, id := range ids {
+		old, ok := t.users[id]
+		if !ok {
+			continue // we'll hear about them from team_join or the next scan
+		}
+		mi := old
+		mi.Active = presence == "active"
+		t.addLocked(id, old, -1)
+		t.users[id] = mi
+		t.addLocked(id, mi, 1)
+	}
+	t.publishLocked()
+	history.record(t.counts, false)
+}
+
+// ids returns the IDs of the counted members
+func (t *memberTracker) ids() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ids := make([]string, 0, len(t.users))
+	for id, mi := range t.users {
+		if t.rules.counted(id, mi) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// current returns the counts as they stand
+func (t *memberTracker) current() memberCounts {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.counts
+}
+
+func (t *memberTracker) addLocked(id string, mi memberInfo, n int64) {
+	if t.rules.ignored(id, mi) {
+		return
+	}
+	if mi.Deleted {
+		t.counts.Deleted += n
+		return
+	}
+	t.categories[mi.Category] += n
+	if mi.guest() {
+		t.counts.Guests += n
+	}
+	if !t.rules.counted(id, mi) {
+		return
+	}
+	t.counts.Total += n
+	if mi.Active {
+		t.counts.Active += n
+	}
+}
+
+func (t *memberTracker) publishLocked() {
+	userCount.Set(t.counts.Total)
+	activeUserCount.Set(t.counts.Active)
+	guestCount.Set(t.counts.Guests)
+	deletedUserCount.Set(t.counts.Deleted)
+	for cat, v := range categoryCounts {
+		v.Set(t.categories[cat])
+	}
+}
+
+// memberCountVars returns the counts for the homepage template, by
+// category plus total, active, guests and deleted
+func memberCountVars() map[string]string {
+	vars := map[string]string{
+		"total":   userCount.String(),
+		"active":  activeUserCount.String(),
+		"guests":  guestCount.String(),
+		"deleted": deletedUserCount.String(),
+	}
+	for cat, v := range categoryCounts {
+		vars[cat] = v.String()
+	}
+	return vars
+}
+
+// maxPresenceSub is how many bytes of IDs a presence_sub frame may carry.
+// Slack drops frames over 16KB, along with the connection.
+const maxPresenceSub = 15 * 1024
+
+// presenceSubIDs returns as many of ids as fit in one presence_sub frame
+func presenceSubIDs(ids []string) []string {
+	size := 0
+	for i, id := range ids {
+		size += len(id) + 3 // quotes and a comma
+		if size > maxPresenceSub {
+			return ids[:i]
+		}
+	}
+	return ids
+}
+
+// rtmCurrent reports whether RTM is keeping the counts current: it's
+// connected, every counted member's presence is subscribed to and presence
+// events have arrived in the last hour. Otherwise the user list is
+// rescanned hourly.
+func rtmCurrent() bool {
+	if rtmConnected.Value() != 1 || presenceLeftOut.Value() != 0 {
+		return false
+	}
+	last := lastPresenceEvent.Value()
+	return last != 0 && time.Since(time.Unix(last, 0)) < time.Hour
+}
+
+// watchSlack keeps the member counts current from the RTM websocket once
+// the first full scan is done, until ctx is done
+func watchSlack(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-members.synced:
+	}
+	rtm := api.NewRTM(slack.RTMOptionUseStart(false))
+	go rtm.ManageConnection()
+	subscribePresence := func() {
+		// presence_sub replaces the previous subscription, so it can't be
+		// split across frames. Big teams get as many members as fit and
+		// the hourly scan for the rest.
+		ids := members.ids()
+		sort.Strings(ids)
+		sub := presenceSubIDs(ids)
+		if len(sub) < len(ids) {
+			log.Printf("subscribing to presence for %d of %d members, the rest are counted hourly", len(sub), len(ids))
+		}
+		rtm.SendMessage(rtm.NewSubscribeUserPresence(sub))
+		presenceSubscribed.Set(int64(len(sub)))
+		presenceLeftOut.Set(int64(len(ids) - len(sub)))
+	}
+	for {
+		var ev slack.RTMEvent
+		select {
+		case <-ctx.Done():
+			// Disconnect waits for the connection manager, which we
+			// don't need to do on the way out
+			go rtm.Disconnect()
+			return
+		case ev = <-rtm.IncomingEvents:
+		}
+		switch e := ev.Data.(type) {
+		case *slack.ConnectedEvent:
+			log.Println("connected to slack RTM")
+			rtmConnected.Set(1)
+			subscribePresence()
+		case *slack.DisconnectedEvent:
+			rtmConnected.Set(0)
+		case *slack.InvalidAuthEvent:
+			log.Println("slack RTM: invalid auth, falling back to polling")
+			rtmConnected.Set(0)
+			rtm.Disconnect()
+			return
+		case *slack.TeamJoinEvent:
+			dispatch(slackEvent{Type: eventTeamJoin, User: &e.User})
+			if presenceLeftOut.Value() == 0 {
+				// otherwise there's no room for them
+				subscribePresence()
+			}
+		case *slack.UserChangeEvent:
+			dispatch(slackEvent{Type: eventUserChange, User: &e.User})
+		case *slack.PresenceChangeEvent:
+			ids := e.Users
+			if e.User != "" {
+				ids = append(ids, e.User)
+			}
+			lastPresenceEvent.Set(time.Now().Unix())
+			dispatch(slackEvent{Type: eventPresenceChange, Users: ids, Presence: e.Presence})
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// withCounts restores every count metric after the test
+func withCounts(t *testing.T) {
+	saved := map[string]int64{
+		"total":   userCount.Value(),
+		"active":  activeUserCount.Value(),
+		"guests":  guestCount.Value(),
+		"deleted": deletedUserCount.Value(),
+	}
+	for cat, v := range categoryCounts {
+		saved[cat] = v.Value()
+	}
+	t.Cleanup(func() {
+		userCount.Set(saved["total"])
+		activeUserCount.Set(saved["active"])
+		guestCount.Set(saved["guests"])
+		deletedUserCount.Set(saved["deleted"])
+		for cat, v := range categoryCounts {
+			v.Set(saved[cat])
+		}
+	})
+}
+
+func TestTrackerWaitsForScan(t *testing.T) {
+	withCounts(t)
+	oldHistory := history
+	history = new(historyStore)
+	t.Cleanup(func() { history = oldHistory })
+
+	// as restored from a snapshot
+	userCount.Set(1200)
+	guestCount.Set(40)
+
+	tr := newMemberTracker()
+	tr.setRules(countingRules{ExcludeAppUsers: true})
+	tr.update(&slack.User{ID: "U1"})
+	tr.setPresence([]string{"U1"}, "active")
+	if got := userCount.Value(); got != 1200 {
+		t.Errorf("before the first scan user_count = %d, want the restored 1200", got)
+	}
+	if got := guestCount.Value(); got != 40 {
+		t.Errorf("before the first scan guest_count = %d, want the restored 40", got)
+	}
+	if n := len(history.points); n != 0 {
+		t.Errorf("%d history points recorded before the first scan, want none", n)
+	}
+
+	tr.replace(map[string]memberInfo{
+		"U1": {Active: true, Category: categoryMember},
+		"U2": {Category: categoryMultiChannelGuest},
+		"U3": {Category: categoryAppUser},
+	})
+	tr.update(&slack.User{ID: "U4"})
+	if got := userCount.Value(); got != 3 {
+		t.Errorf("after the first scan user_count = %d, want 3", got)
+	}
+	if got := guestCount.Value(); got != 1 {
+		t.Errorf("after the first scan guest_count = %d, want 1", got)
+	}
+	if len(history.points) == 0 || history.points[0].Total != 2 {
+		t.Errorf("history starts %+v, want the first scan's counts", history.points)
+	}
+}
+
+func TestSnapshotKeepsAllCounts(t *testing.T) {
+	withCounts(t)
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	userCount.Set(1200)
+	activeUserCount.Set(300)
+	guestCount.Set(40)
+	deletedUserCount.Set(7)
+	for cat, v := range categoryCounts {
+		v.Set(int64(len(cat)))
+	}
+	if err := saveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	userCount.Set(0)
+	activeUserCount.Set(0)
+	guestCount.Set(0)
+	deletedUserCount.Set(0)
+	for _, v := range categoryCounts {
+		v.Set(0)
+	}
+	loadSnapshot(path)
+	for _, tt := range []struct {
+		name string
+		v    *expvar.Int
+		want int64
+	}{
+		{"user_count", &userCount, 1200},
+		{"active_user_count", &activeUserCount, 300},
+		{"guest_count", &guestCount, 40},
+		{"deleted_user_count", &deletedUserCount, 7},
+	} {
+		if got := tt.v.Value(); got != tt.want {
+			t.Errorf("restored %s = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+	for cat, v := range categoryCounts {
+		if got := v.Value(); got != int64(len(cat)) {
+			t.Errorf("restored %s = %d, want %d", cat, got, len(cat))
+		}
+	}
+}
+
+func TestPresenceSubFitsAFrame(t *testing.T) {
+	for _, n := range []int{0, 10, 1000, 5000} {
+		ids := make([]string, n)
+		for i := range ids {
+			ids[i] = fmt.Sprintf("U%010d", i)
+		}
+		sub := presenceSubIDs(ids)
+		b, err := json.Marshal(slack.OutgoingMessage{ID: 1 << 30, Type: "presence_sub", IDs: sub})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) > 16*1024 {
+			t.Errorf("presence_sub for %d members is %d bytes, over slack's 16KB", n, len(b))
+		}
+		if n <= 1000 && len(sub) != n {
+			t.Errorf("subscribed to %d of %d members, want all of them", len(sub), n)
+		}
+	}
+}
+
+func TestRTMCurrent(t *testing.T) {
+	defer func(connected, leftOut, last int64) {
+		rtmConnected.Set(connected)
+		presenceLeftOut.Set(leftOut)
+		lastPresenceEvent.Set(last)
+	}(rtmConnected.Value(), presenceLeftOut.Value(), lastPresenceEvent.Value())
+	now := time.Now().Unix()
+	tests := []struct {
+		name                     string
+		connected, leftOut, last int64
+		want                     bool
+	}{
+		{"presence arriving", 1, 0, now, true},
+		{"disconnected", 0, 0, now, false},
+		{"members left out", 1, 12, now, false},
+		{"no presence events yet", 1, 0, 0, false},
+		{"presence events stopped", 1, 0, now - 2*3600, false},
+	}
+	for _, tt := range tests {
+		rtmConnected.Set(tt.connected)
+		presenceLeftOut.Set(tt.leftOut)
+		lastPresenceEvent.Set(tt.last)
+		if got := rtmCurrent(); got != tt.want {
+			t.Errorf("%s: rtmCurrent() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
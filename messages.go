@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// messages holds the user facing text for each result code by language.
+// {domain} and {support} are replaced with the team's slack domain and the
+// support email address, {field} with the label of the field at fault.
+var messages = map[string]map[string]string{
+	"en": {
+		resultInvited:          "WOOT. Check your email!",
+		resultPending:          "Thanks! A moderator will review your request shortly.",
+		resultQueued:           "Thanks! Your invite is on its way, check your email in a few minutes.",
+		resultConfirm:          "Almost there! We've emailed you a link, follow it to get your invite.",
+		msgConfirmPrompt:       "Press the button to confirm your email address and get your invite.",
+		msgConfirmButton:       "Confirm and get my invite",
+		codeMissingEmail:       "Missing email",
+		codeMissingFirstName:   "Missing first name",
+		codeMissingLastName:    "Missing last name",
+		codeMissingCoC:         "You need to accept the code of conduct",
+		codeInvalidField:       "Please check the {field} field",
+		codeDomainDenied:       "We can't accept invite requests from that email domain",
+		codeInviteCodeInvalid:  "That invite code is unknown, expired or used up.",
+		codeMalformedEmail:     "That doesn't look like an email address.",
+		codeDisposableEmail:    "Please use a permanent email address, not a throwaway one.",
+		codeUndeliverableEmail: "That email domain can't receive email. Is there a typo?",
+		codeCaptchaError:       "We couldn't check the captcha. Did you complete it?",
+		codeCaptchaInvalid:     "We couldn't verify that you're human. Please try the captcha again.",
+		codeCaptchaUnavailable: "We can't check the captcha right now, please reload the page and try again in a minute.",
+		codeBadRequest:         "Invalid request",
+		codeTooManyRequests:    "Too many invite requests, please try again later.",
+		codeInternalError:      "Something went wrong, please try again.",
+		codeConfirmFailed:      "We couldn't send you a confirmation email, please try again later.",
+		codeConfirmExpired:     "That confirmation link has expired, please ask for an invite again.",
+		codeConfirmInvalid:     "That confirmation link isn't valid or has already been used.",
+		codeFormExpired:        "This page has expired, please reload it and try again.",
+		codeBotDetected:        "Sorry, that looked like an automated request. Please reload the page and try again.",
+		codeAlreadyInTeam:      "You're already a member! Sign in at https://{domain}.slack.com",
+		codeAlreadyInvited:     "You've already been invited. Check your email (and spam folder) for the invite.",
+		codeDeactivated:        "That account has been deactivated. Please contact {support}.",
+		codeInvalidEmail:       "Slack didn't accept that email address.",
+		codeNotAllowed:         "We're not able to invite that address.",
+		codeRateLimited:        "Slack is busy right now, please try again in a minute.",
+		codeSlackError:         "Slack returned an error, please try again later.",
+	},
+	"de": {
+		resultInvited:          "Juhu! Schau in dein Postfach!",
+		resultPending:          "Danke! Ein Moderator prüft deine Anfrage in Kürze.",
+		resultQueued:           "Danke! Deine Einladung ist unterwegs, schau in ein paar Minuten in dein Postfach.",
+		resultConfirm:          "Fast geschafft! Wir haben dir einen Link geschickt, öffne ihn, um deine Einladung zu bekommen.",
+		msgConfirmPrompt:       "Drück den Knopf, um deine E-Mail-Adresse zu bestätigen und deine Einladung zu bekommen.",
+		msgConfirmButton:       "Bestätigen und Einladung holen",
+		codeMissingEmail:       "E-Mail-Adresse fehlt",
+		codeMissingFirstName:   "Vorname fehlt",
+		codeMissingLastName:    "Nachname fehlt",
+		codeMissingCoC:         "Du musst den Verhaltenskodex akzeptieren",
+		codeInvalidField:       "Bitte prüfe das Feld {field}",
+		codeDomainDenied:       "Von dieser E-Mail-Domain können wir keine Anfragen annehmen",
+		codeInviteCodeInvalid:  "Dieser Einladungscode ist unbekannt, abgelaufen oder aufgebraucht.",
+		codeMalformedEmail:     "Das sieht nicht wie eine E-Mail-Adresse aus.",
+		codeDisposableEmail:    "Bitte verwende eine dauerhafte E-Mail-Adresse, keine Wegwerfadresse.",
+		codeUndeliverableEmail: "Diese E-Mail-Domain kann keine E-Mails empfangen. Vertippt?",
+		codeCaptchaError:       "Fehler beim Prüfen des Captchas. Hast du es angeklickt?",
+		codeCaptchaInvalid:     "Wir konnten nicht bestätigen, dass du ein Mensch bist. Bitte versuche das Captcha noch einmal.",
+		codeCaptchaUnavailable: "Wir können das Captcha gerade nicht prüfen, bitte lade die Seite neu und versuche es in einer Minute noch einmal.",
+		codeBadRequest:         "Ungültige Anfrage",
+		codeTooManyRequests:    "Zu viele Anfragen, bitte versuche es später noch einmal.",
+		codeInternalError:      "Etwas ist schiefgelaufen, bitte versuche es noch einmal.",
+		codeConfirmFailed:      "Wir konnten dir keine Bestätigungs-E-Mail schicken, bitte versuche es später noch einmal.",
+		codeConfirmExpired:     "Dieser Bestätigungslink ist abgelaufen, bitte fordere erneut eine Einladung an.",
+		codeConfirmInvalid:     "Dieser Bestätigungslink ist ungültig oder wurde schon benutzt.",
+		codeFormExpired:        "Diese Seite ist abgelaufen, bitte lade sie neu und versuche es noch einmal.",
+		codeBotDetected:        "Das sah nach einer automatisierten Anfrage aus. Bitte lade die Seite neu und versuche es noch einmal.",
+		codeAlreadyInTeam:      "Du bist schon Mitglied! Melde dich unter https://{domain}.slack.com an",
+		codeAlreadyInvited:     "Du wurdest bereits eingeladen. Schau in dein Postfach (und den Spam-Ordner).",
+		codeDeactivated:        "Dieses Konto wurde deaktiviert. Bitte wende dich an {support}.",
+		codeInvalidEmail:       "Slack hat diese E-Mail-Adresse nicht akzeptiert.",
+		codeNotAllowed:         "Wir können diese Adresse nicht einladen.",
+		codeRateLimited:        "Slack ist gerade ausgelastet, bitte versuche es in einer Minute noch einmal.",
+		codeSlackError:         "Slack hat einen Fehler gemeldet, bitte versuche es später noch einmal.",
+	},
+	"es": {
+		resultInvited:          "¡Genial! Revisa tu correo.",
+		resultPending:          "¡Gracias! Un moderador revisará tu solicitud en breve.",
+		resultQueued:           "¡Gracias! Tu invitación está en camino, revisa tu correo en unos minutos.",
+		resultConfirm:          "¡Casi listo! Te enviamos un enlace por correo, ábrelo para recibir tu invitación.",
+		msgConfirmPrompt:       "Pulsa el botón para confirmar tu correo y recibir tu invitación.",
+		msgConfirmButton:       "Confirmar y recibir mi invitación",
+		codeMissingEmail:       "Falta el correo electrónico",
+		codeMissingFirstName:   "Falta el nombre",
+		codeMissingLastName:    "Falta el apellido",
+		codeMissingCoC:         "Debes aceptar el código de conducta",
+		codeInvalidField:       "Revisa el campo {field}",
+		codeDomainDenied:       "No aceptamos solicitudes de ese dominio de correo",
+		codeInviteCodeInvalid:  "Ese código de invitación no existe, caducó o ya se agotó.",
+		codeMalformedEmail:     "Eso no parece una dirección de correo.",
+		codeDisposableEmail:    "Usa una dirección de correo permanente, no una desechable.",
+		codeUndeliverableEmail: "Ese dominio no puede recibir correo. ¿Hay un error de escritura?",
+		codeCaptchaError:       "Error al validar el captcha. ¿Lo marcaste?",
+		codeCaptchaInvalid:     "No pudimos verificar que eres humano. Vuelve a intentar el captcha.",
+		codeCaptchaUnavailable: "Ahora mismo no podemos comprobar el captcha, recarga la página y vuelve a intentarlo en un minuto.",
+		codeBadRequest:         "Solicitud no válida",
+		codeTooManyRequests:    "Demasiadas solicitudes, inténtalo más tarde.",
+		codeInternalError:      "Algo salió mal, inténtalo de nuevo.",
+		codeConfirmFailed:      "No pudimos enviarte el correo de confirmación, inténtalo más tarde.",
+		codeConfirmExpired:     "Ese enlace de confirmación caducó, vuelve a solicitar la invitación.",
+		codeConfirmInvalid:     "Ese enlace de confirmación no es válido o ya se usó.",
+		codeFormExpired:        "Esta página ha caducado, recárgala e inténtalo de nuevo.",
+		codeBotDetected:        "Eso parecía una solicitud automatizada. Recarga la página e inténtalo de nuevo.",
+		codeAlreadyInTeam:      "¡Ya eres miembro! Inicia sesión en https://{domain}.slack.com",
+		codeAlreadyInvited:     "Ya recibiste una invitación. Revisa tu correo (y la carpeta de spam).",
+		codeDeactivated:        "Esa cuenta ha sido desactivada. Escribe a {support}.",
+		codeInvalidEmail:       "Slack no aceptó esa dirección de correo.",
+		codeNotAllowed:         "No podemos invitar a esa dirección.",
+		codeRateLimited:        "Slack está ocupado, inténtalo de nuevo en un minuto.",
+		codeSlackError:         "Slack devolvió un error, inténtalo más tarde.",
+	},
+}
+
+const defaultLang = "en"
+
+// message returns the text for code in lang, falling back to English.
+// args are extra placeholder, value pairs.
+func message(lang, code string, args ...string) string {
+	msg, ok := messages[lang][code]
+	if !ok {
+		msg, ok = messages[defaultLang][code]
+	}
+	if !ok {
+		msg = code
+	}
+	args = append(args, "{domain}", ourTeam.Domain(), "{support}", c.SupportEmail)
+	return strings.NewReplacer(args...).Replace(msg)
+}
+
+// requestLang picks the first language in the Accept-Language header that
+// we have messages for. Quality values are ignored, browsers list
+// languages in order of preference anyway.
+func requestLang(r *http.Request) string {
+	for _, tag := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag = strings.TrimSpace(strings.SplitN(tag, ";", 2)[0])
+		tag = strings.ToLower(strings.SplitN(tag, "-", 2)[0])
+		if _, ok := messages[tag]; ok {
+			return tag
+		}
+	}
+	return defaultLang
+}
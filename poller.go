@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// backoff is an exponential backoff with jitter
+type backoff struct {
+	base, max time.Duration
+	failures  int
+}
+
+// next records a failure and returns how long to wait before trying again
+func (b *backoff) next() time.Duration {
+	b.failures++
+	d := b.base
+	for i := 1; i < b.failures && d < b.max; i++ {
+		d *= 2
+	}
+	if d > b.max {
+		d = b.max
+	}
+	return jitter(d)
+}
+
+func (b *backoff) reset() {
+	b.failures = 0
+}
+
+// jitter adds up to a fifth to d so that instances don't retry in lockstep
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Int63n(int64(d)/5+1))
+}
+
+// sleep waits for d, reporting false if ctx is done first
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// team info is cheap and needed for invites, so it's retried sooner than
+// the user list
+var (
+	teamInfoBackoff = backoff{base: 15 * time.Second, max: 10 * time.Minute}
+	userListBackoff = backoff{base: time.Minute, max: 30 * time.Minute}
+)
+
+// pollSlack keeps the team info and member counts up to date until ctx is
+// done
+func pollSlack(ctx context.Context) {
+	for {
+		d := updateFromSlack(ctx)
+		if !sleep(ctx, d) {
+			return
+		}
+		// while RTM keeps the counts current a scan is only needed to
+		// correct drift, but check hourly that it still does
+		for rtmCurrent() && time.Since(time.Unix(lastPollSuccess.Value(), 0)) < c.ReconcileInterval {
+			if !sleep(ctx, time.Hour) {
+				return
+			}
+		}
+	}
+}
+
+// updateFromSlack refreshes the team info and rescans the user list,
+// returning how long to wait before doing it again
+func updateFromSlack(ctx context.Context) time.Duration {
+	start := time.Now()
+	defer func() {
+		pollDuration.Set(int64(time.Since(start) / time.Millisecond))
+	}()
+
+	// load team info first as it's much faster than paginating user count
+	st, err := api.GetTeamInfoContext(ctx)
+	if err != nil {
+		pollFailed("team info", err)
+		if rle, ok := err.(*slack.RateLimitedError); ok {
+			return jitter(rle.RetryAfter)
+		}
+		return teamInfoBackoff.next()
+	}
+	teamInfoBackoff.reset()
+	ourTeam.Update(st)
+
+	users := make(map[string]memberInfo)
+	p := api.GetUsersPaginated(
+		slack.GetUsersOptionPresence(true),
+		slack.GetUsersOptionLimit(500),
+	)
+	for {
+		next, err := p.Next(ctx)
+		if next.Done(err) {
+			break
+		}
+		if rle, ok := err.(*slack.RateLimitedError); ok {
+			// retry the same page; p still has the cursor that got us here
+			log.Println("rate limited by slack, retrying users.list in", rle.RetryAfter)
+			if !sleep(ctx, jitter(rle.RetryAfter)) {
+				return 0
+			}
+			continue
+		}
+		if err != nil {
+			pollFailed("users", err)
+			return userListBackoff.next()
+		}
+		p = next
+		for i := range p.Users {
+			u := &p.Users[i]
+			users[u.ID] = memberInfoFor(u)
+		}
+	}
+	userListBackoff.reset()
+	members.replace(users)
+	lastPollSuccess.Set(time.Now().Unix())
+	if err := saveSnapshot(c.SnapshotPath); err != nil {
+		log.Println("error saving snapshot:", err)
+	}
+	n := members.current()
+	log.Printf("counted %d users, %d active, in %s", n.Total, n.Active, time.Since(start).Round(time.Millisecond))
+
+	return time.Hour
+}
+
+func pollFailed(what string, err error) {
+	log.Printf("error polling slack for %s: %v", what, err)
+	lastPollError.Set(what + ": " + err.Error())
+	lastPollErrorTime.Set(time.Now().Unix())
+}
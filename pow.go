@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const captchaPoW = "pow"
+
+// powResponseField is the form field a solved challenge is posted in
+const powResponseField = "pow-response"
+
+// powCaptcha is a hashcash style proof of work challenge that needs no
+// third party. Each page gets a signed challenge; the browser has to find a
+// counter such that sha256(challenge + ":" + counter) starts with the
+// challenge's number of zero bits. Challenges expire and can be used once.
+type powCaptcha struct {
+	key           []byte
+	minDifficulty int
+	maxDifficulty int
+	ttl           time.Duration
+	used          *nonceCache
+}
+
+func newPoWCaptcha(secret string, minDifficulty, maxDifficulty int) *powCaptcha {
+	key := []byte(secret)
+	if len(key) == 0 {
+		// challenges won't survive a restart or work across dynos, but
+		// that's better than a guessable key
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic(err)
+		}
+	}
+	if maxDifficulty < minDifficulty {
+		maxDifficulty = minDifficulty
+	}
+	return &powCaptcha{
+		key:           key,
+		minDifficulty: minDifficulty,
+		maxDifficulty: maxDifficulty,
+		ttl:           time.Hour,
+		used:          newNonceCache(),
+	}
+}
+
+// difficulty adds a bit, doubling the expected work, each time the
+// homepage hit rate doubles past 60 a minute
+func (p *powCaptcha) difficulty() int {
+	d := p.minDifficulty
+	for rate := hitsPerMinute.Value(); rate > 60 && d < p.maxDifficulty; rate /= 2 {
+		d++
+	}
+	return d
+}
+
+// Challenge returns a new signed challenge: nonce.difficulty.expiry.mac
+func (p *powCaptcha) Challenge() string {
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	payload := fmt.Sprintf("%x.%d.%d", nonce, p.difficulty(), time.Now().Add(p.ttl).Unix())
+	return payload + "." + p.sign(payload)
+}
+
+func (p *powCaptcha) sign(payload string) string {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a "challenge:counter" response
+func (p *powCaptcha) Verify(_ context.Context, response, _ string) (captchaResult, error) {
+	i := strings.LastIndex(response, ":")
+	if i < 0 {
+		return captchaResult{}, errors.New("malformed proof of work")
+	}
+	challenge := response[:i]
+	parts := strings.Split(challenge, ".")
+	if len(parts) != 4 {
+		return captchaResult{}, errors.New("malformed proof of work challenge")
+	}
+	nonce, payload := parts[0], strings.Join(parts[:3], ".")
+	if !hmac.Equal([]byte(parts[3]), []byte(p.sign(payload))) {
+		return captchaResult{Success: false}, nil
+	}
+	difficulty, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return captchaResult{}, err
+	}
+	exp, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return captchaResult{}, err
+	}
+	expires := time.Unix(exp, 0)
+	if time.Now().After(expires) {
+		return captchaResult{Success: false}, nil
+	}
+	sum := sha256.Sum256([]byte(response))
+	if leadingZeroBits(sum[:]) < difficulty {
+		return captchaResult{Success: false}, nil
+	}
+	if !p.used.use(nonce, expires) {
+		return captchaResult{Success: false}, nil
+	}
+	return captchaResult{Success: true}, nil
+}
+
+func (p *powCaptcha) Widget() captchaWidget {
+	return captchaWidget{Provider: captchaPoW, ResponseField: powResponseField}
+}
+
+func leadingZeroBits(b []byte) int {
+	n := 0
+	for _, x := range b {
+		if x != 0 {
+			return n + bits.LeadingZeros8(x)
+		}
+		n += 8
+	}
+	return n
+}
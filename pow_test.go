@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// powChallenge builds a challenge the way Challenge does, with a chosen
+// nonce, difficulty and expiry
+func powChallenge(p *powCaptcha, nonce string, difficulty int, expires time.Time) string {
+	payload := fmt.Sprintf("%s.%d.%d", nonce, difficulty, expires.Unix())
+	return payload + "." + p.sign(payload)
+}
+
+// underSolve returns a response to challenge that falls short of 4 bits of
+// work
+func underSolve(challenge string) string {
+	for i := 0; ; i++ {
+		response := challenge + ":" + strconv.Itoa(i)
+		sum := sha256.Sum256([]byte(response))
+		if leadingZeroBits(sum[:]) < 4 {
+			return response
+		}
+	}
+}
+
+func TestPoWVerify(t *testing.T) {
+	p := newPoWCaptcha("secret", 4, 4)
+	other := newPoWCaptcha("other secret", 4, 4)
+	hour := time.Now().Add(time.Hour)
+	tests := []struct {
+		name     string
+		response string
+		want     bool
+	}{
+		{"solved", solveChallenge(powChallenge(p, "01", 4, hour)), true},
+		{"signed with another key", solveChallenge(powChallenge(other, "02", 4, hour)), false},
+		{"mac altered", solveChallenge(powChallenge(p, "03", 4, hour) + "00"), false},
+		{"expired", solveChallenge(powChallenge(p, "04", 4, time.Now().Add(-time.Minute))), false},
+		{"not enough work", underSolve(powChallenge(p, "05", 4, hour)), false},
+		{"difficulty raised, not enough work", solveChallenge(powChallenge(p, "06", 32, hour)), false},
+	}
+	for _, tt := range tests {
+		res, _ := p.Verify(context.Background(), tt.response, "")
+		if res.Success != tt.want {
+			t.Errorf("%s: success = %v, want %v", tt.name, res.Success, tt.want)
+		}
+	}
+
+	// lowering the difficulty breaks the mac
+	challenge := powChallenge(p, "07", 32, hour)
+	if res, _ := p.Verify(context.Background(), solveChallenge(challenge[:3]+"4"+challenge[5:]), ""); res.Success {
+		t.Error("a challenge with its difficulty lowered passed")
+	}
+
+	answer := solveChallenge(powChallenge(p, "08", 4, hour))
+	if res, _ := p.Verify(context.Background(), answer, ""); !res.Success {
+		t.Fatal("a solved challenge failed")
+	}
+	if res, _ := p.Verify(context.Background(), answer, ""); res.Success {
+		t.Error("a solved challenge passed twice")
+	}
+}
+
+func TestPoWVerifyMalformed(t *testing.T) {
+	p := newPoWCaptcha("secret", 4, 4)
+	for _, response := range []string{"", "no counter", "a.b:1", "a.b.c.d.e:1"} {
+		if _, err := p.Verify(context.Background(), response, ""); err == nil {
+			t.Errorf("Verify(%q) took a malformed response", response)
+		}
+	}
+}
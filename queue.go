@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// deliveryItem is an invite waiting to be sent to slack
+type deliveryItem struct {
+	Record      inviteRecord `json:"record"`
+	Attempts    int          `json:"attempts"`
+	NextAttempt time.Time    `json:"next_attempt"`
+	LastError   string       `json:"last_error,omitempty"`
+}
+
+// deliveryQueue sends invites in the background, retrying transient
+// failures with exponential backoff. Items that keep failing end up on the
+// dead letter list until an admin replays them. The whole queue is
+// rewritten to a JSON file on every change so it survives restarts, as
+// long as the disk it's on does.
+type deliveryQueue struct {
+	path        string
+	maxAttempts int
+
+	mu          sync.Mutex
+	waiting     map[string]*deliveryItem
+	inflight    map[string]bool
+	dead        map[string]*deliveryItem
+	pausedUntil time.Time // set when slack rate limits us
+	wake        chan struct{}
+}
+
+// deliveryState is the on disk format of a deliveryQueue
+type deliveryState struct {
+	Waiting []*deliveryItem `json:"waiting"`
+	Dead    []*deliveryItem `json:"dead"`
+}
+
+const (
+	deliveryBackoffBase = 5 * time.Second
+	deliveryBackoffMax  = 30 * time.Minute
+)
+
+func openDeliveryQueue(path string, maxAttempts int) (*deliveryQueue, error) {
+	q := &deliveryQueue{
+		path:        path,
+		maxAttempts: maxAttempts,
+		waiting:     make(map[string]*deliveryItem),
+		inflight:    make(map[string]bool),
+		dead:        make(map[string]*deliveryItem),
+		wake:        make(chan struct{}, 1),
+	}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st deliveryState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return nil, err
+	}
+	for _, it := range st.Waiting {
+		q.waiting[it.Record.ID] = it
+	}
+	for _, it := range st.Dead {
+		q.dead[it.Record.ID] = it
+	}
+	q.updateMetrics()
+	return q, nil
+}
+
+// add queues rec for delivery
+func (q *deliveryQueue) add(rec inviteRecord) error {
+	q.mu.Lock()
+	q.waiting[rec.ID] = &deliveryItem{Record: rec, NextAttempt: time.Now()}
+	err := q.saveLocked()
+	q.mu.Unlock()
+	q.signal()
+	return err
+}
+
+// replay moves a dead letter back onto the queue with a fresh set of
+// attempts
+func (q *deliveryQueue) replay(id string) error {
+	q.mu.Lock()
+	it, ok := q.dead[id]
+	if !ok {
+		q.mu.Unlock()
+		return errors.New("no such dead letter")
+	}
+	delete(q.dead, id)
+	it.Attempts = 0
+	it.NextAttempt = time.Now()
+	q.waiting[id] = it
+	err := q.saveLocked()
+	q.mu.Unlock()
+	q.signal()
+	return err
+}
+
+// holds reports whether the invite with the given ID is waiting or a dead
+// letter
+func (q *deliveryQueue) holds(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.waiting[id] != nil || q.dead[id] != nil
+}
+
+// flush saves the queue to disk
+func (q *deliveryQueue) flush() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.saveLocked()
+}
+
+// items returns copies of the waiting items and dead letters, oldest first
+func (q *deliveryQueue) items() (waiting, dead []deliveryItem) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, it := range q.waiting {
+		waiting = append(waiting, *it)
+	}
+	for _, it := range q.dead {
+		dead = append(dead, *it)
+	}
+	byTime := func(s []deliveryItem) func(i, j int) bool {
+		return func(i, j int) bool { return s[i].Record.Time.Before(s[j].Record.Time) }
+	}
+	sort.Slice(waiting, byTime(waiting))
+	sort.Slice(dead, byTime(dead))
+	return waiting, dead
+}
+
+// run starts n workers that deliver invites until ctx is done
+func (q *deliveryQueue) run(ctx context.Context, n int) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (q *deliveryQueue) work(ctx context.Context) {
+	for {
+		it, wait := q.next()
+		if it == nil {
+			t := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return
+			case <-q.wake:
+			case <-t.C:
+			}
+			t.Stop()
+			continue
+		}
+		q.deliver(it)
+	}
+}
+
+// next claims the next due item, or says how long to wait for one
+func (q *deliveryQueue) next() (*deliveryItem, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	if now.Before(q.pausedUntil) {
+		return nil, q.pausedUntil.Sub(now)
+	}
+	var due *deliveryItem
+	wait := time.Minute
+	for id, it := range q.waiting {
+		if q.inflight[id] {
+			continue
+		}
+		if d := it.NextAttempt.Sub(now); d > 0 {
+			if d < wait {
+				wait = d
+			}
+			continue
+		}
+		if due == nil || it.NextAttempt.Before(due.NextAttempt) {
+			due = it
+		}
+	}
+	if due != nil {
+		q.inflight[due.Record.ID] = true
+	}
+	return due, wait
+}
+
+func (q *deliveryQueue) deliver(it *deliveryItem) {
+	rec := it.Record
+	ie := sendInvite(&rec)
+
+	q.mu.Lock()
+	delete(q.inflight, rec.ID)
+	it.Attempts++
+	switch {
+	case ie == nil || !transientInviteError(ie):
+		// done, one way or the other; the ledger has the outcome
+		delete(q.waiting, rec.ID)
+	case it.Attempts >= q.maxAttempts:
+		log.Printf("giving up on invite %s after %d attempts: %v", rec.ID, it.Attempts, ie)
+		it.LastError = ie.Error()
+		delete(q.waiting, rec.ID)
+		q.dead[rec.ID] = it
+	default:
+		it.LastError = ie.Error()
+		delay := deliveryBackoff(it.Attempts)
+		if ie.Code == codeRateLimited && ie.RetryAfter > 0 {
+			// slack's limit is per token so every worker has to wait
+			q.pausedUntil = time.Now().Add(ie.RetryAfter)
+			if ie.RetryAfter > delay {
+				delay = ie.RetryAfter
+			}
+		}
+		it.NextAttempt = time.Now().Add(delay)
+		deliveryRetries.Add(1)
+		// keep the ledger saying queued until we're done with it
+		rec.Outcome = outcomeQueued
+	}
+	if err := q.saveLocked(); err != nil {
+		log.Println("error saving delivery queue:", err)
+	}
+	q.mu.Unlock()
+	logInvite(&rec)
+}
+
+// transientInviteError reports whether trying again later might work
+func transientInviteError(ie *inviteError) bool {
+	return ie.Code == codeRateLimited || ie.Code == codeSlackError
+}
+
+// deliveryBackoff returns the delay before the next attempt
+func deliveryBackoff(attempts int) time.Duration {
+	d := deliveryBackoffBase
+	for i := 1; i < attempts && d < deliveryBackoffMax; i++ {
+		d *= 2
+	}
+	if d > deliveryBackoffMax {
+		d = deliveryBackoffMax
+	}
+	return d
+}
+
+func (q *deliveryQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// saveLocked writes the queue to disk. q.mu must be held.
+func (q *deliveryQueue) saveLocked() error {
+	q.updateMetrics()
+	var st deliveryState
+	for _, it := range q.waiting {
+		st.Waiting = append(st.Waiting, it)
+	}
+	for _, it := range q.dead {
+		st.Dead = append(st.Dead, it)
+	}
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp := q.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path)
+}
+
+func (q *deliveryQueue) updateMetrics() {
+	deliveryQueueDepth.Set(int64(len(q.waiting)))
+	deadLetters.Set(int64(len(q.dead)))
+}
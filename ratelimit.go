@@ -0,0 +1,165 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// limiter is a set of token buckets, one per key. Each bucket holds up to
+// burst tokens and refills at rate tokens per second.
+type limiter struct {
+	rate, burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newLimiter returns a limiter allowing perHour requests an hour per key,
+// all of which may be used at once. It returns nil, which allows
+// everything, when perHour is 0.
+func newLimiter(perHour int) *limiter {
+	if perHour <= 0 {
+		return nil
+	}
+	return &limiter{
+		rate:    float64(perHour) / time.Hour.Seconds(),
+		burst:   float64(perHour),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// allow takes a token from key's bucket. When the bucket is empty it
+// returns false and how long until a token is available.
+func (l *limiter) allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep forgets buckets that have refilled, once a minute. l.mu must be
+// held.
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// clientIP returns the address of the client that made r. Behind a proxy
+// such as the Heroku router the last X-Forwarded-For entry is the one the
+// proxy added, so it's the only one that can be trusted.
+func clientIP(r *http.Request) string {
+	if c.TrustProxy {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			hops := strings.Split(xff, ",")
+			return strings.TrimSpace(hops[len(hops)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ipPrefix returns the /24 (IPv4) or /64 (IPv6) network containing ip,
+// since a single client usually controls at least that much
+func ipPrefix(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return parsed.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// normalizeEmail folds the ways people write the same mailbox together:
+// case, +tags and, for gmail, dots in the local part
+func normalizeEmail(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	i := strings.LastIndex(email, "@")
+	if i < 0 {
+		return email
+	}
+	local, domain := email[:i], email[i+1:]
+	if j := strings.Index(local, "+"); j >= 0 {
+		local = local[:j]
+	}
+	if domain == "gmail.com" || domain == "googlemail.com" {
+		local = strings.Replace(local, ".", "", -1)
+		domain = "gmail.com"
+	}
+	return local + "@" + domain
+}
+
+var ipLimiter, prefixLimiter, emailLimiter *limiter
+
+// checkRateLimits applies the per IP and per network limits, returning an
+// error if either is exceeded. Requests with a valid invite code skip them:
+// the code's usage limit already bounds them, and a room full of people
+// redeeming one at an event shares a single address.
+func checkRateLimits(ip string, hasCode bool) *inviteError {
+	if hasCode {
+		return nil
+	}
+	if ok, wait := ipLimiter.allow(ip); !ok {
+		rateLimitedIP.Add(1)
+		return tooManyRequests(wait)
+	}
+	if ok, wait := prefixLimiter.allow(ipPrefix(ip)); !ok {
+		rateLimitedPrefix.Add(1)
+		return tooManyRequests(wait)
+	}
+	return nil
+}
+
+// checkEmailLimit applies the per email limit. It's only charged once a
+// request has passed validation and the captcha, so that someone who fumbles
+// the form a few times doesn't lock themselves out.
+func checkEmailLimit(email string) *inviteError {
+	if ok, wait := emailLimiter.allow(normalizeEmail(email)); !ok {
+		rateLimitedEmail.Add(1)
+		return tooManyRequests(wait)
+	}
+	return nil
+}
+
+func tooManyRequests(wait time.Duration) *inviteError {
+	ie := newInviteError(codeTooManyRequests, nil)
+	ie.RetryAfter = wait
+	return ie
+}
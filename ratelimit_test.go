@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiterRefills(t *testing.T) {
+	l := newLimiter(2)
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("gopher"); !ok {
+			t.Fatalf("request %d of the burst was limited", i+1)
+		}
+	}
+	ok, wait := l.allow("gopher")
+	if ok {
+		t.Fatal("a request past the burst was allowed")
+	}
+	if wait <= 29*time.Minute || wait > 30*time.Minute {
+		t.Errorf("told to wait %v for a token, want about 30m", wait)
+	}
+	if ok, _ := l.allow("other"); !ok {
+		t.Error("one key's requests limited another's")
+	}
+
+	// half an hour on, one token has come back
+	l.buckets["gopher"].last = l.buckets["gopher"].last.Add(-30 * time.Minute)
+	if ok, _ := l.allow("gopher"); !ok {
+		t.Error("the bucket didn't refill")
+	}
+	if ok, _ := l.allow("gopher"); ok {
+		t.Error("the bucket refilled more than it should have")
+	}
+
+	// long after, the bucket is full again but no fuller
+	l.buckets["gopher"].last = l.buckets["gopher"].last.Add(-24 * time.Hour)
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("gopher"); !ok {
+			t.Fatalf("request %d after a refill was limited", i+1)
+		}
+	}
+	if ok, _ := l.allow("gopher"); ok {
+		t.Error("the bucket refilled past its burst")
+	}
+}
+
+func TestLimiterSweep(t *testing.T) {
+	l := newLimiter(2)
+	l.allow("gopher")
+	l.allow("other")
+	l.buckets["gopher"].last = l.buckets["gopher"].last.Add(-time.Hour)
+	l.lastSweep = time.Time{}
+	l.allow("third")
+	if _, ok := l.buckets["gopher"]; ok {
+		t.Error("a refilled bucket wasn't swept")
+	}
+	if _, ok := l.buckets["other"]; !ok {
+		t.Error("a bucket still refilling was swept")
+	}
+}
+
+func TestNilLimiterAllows(t *testing.T) {
+	l := newLimiter(0)
+	for i := 0; i < 100; i++ {
+		if ok, _ := l.allow("gopher"); !ok {
+			t.Fatal("a disabled limiter limited a request")
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// settings holds the structured configuration that doesn't fit in
+// environment variables. It is read from the JSON file named by
+// SLACKINVITER_SETTINGSFILE.
+type settings struct {
+	// Profiles by name. A "default" profile, if present, is used when no
+	// rule matches, otherwise people are invited as full members.
+	Profiles map[string]inviteProfile `json:"profiles"`
+	// ProfileRules are checked in order, the first match wins
+	ProfileRules []profileRule `json:"profile_rules"`
+	// DomainPolicies are checked in order, the first match wins
+	DomainPolicies []domainPolicy `json:"domain_policies"`
+	// DisposableDomains are treated as throwaway mail providers on top of
+	// the built in list, AllowedDisposableDomains are taken off it
+	DisposableDomains        domainSet `json:"disposable_domains"`
+	AllowedDisposableDomains domainSet `json:"allowed_disposable_domains"`
+	// Fields are extra questions on the invite form
+	Fields []formField `json:"fields"`
+	// Counting decides who counts towards the member total
+	Counting countingRules `json:"counting"`
+}
+
+// domainSet is a set of lower cased domains, written as a JSON list
+type domainSet map[string]bool
+
+func (ds *domainSet) UnmarshalJSON(b []byte) error {
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*ds = stringSet(list...)
+	return nil
+}
+
+var currentSettings atomic.Value // *settings
+
+func init() {
+	currentSettings.Store(new(settings))
+}
+
+// getSettings returns the settings in effect
+func getSettings() *settings {
+	return currentSettings.Load().(*settings)
+}
+
+// loadSettings reads and validates a settings file
+func loadSettings(path string) (*settings, error) {
+	s := new(settings)
+	if path == "" {
+		return s, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	if err := s.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return s, nil
+}
+
+func (s *settings) validate() error {
+	for name, p := range s.Profiles {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("profile %q: %v", name, err)
+		}
+	}
+	fallback, _ := s.profile(s.profileFor("", ""))
+	for i, rule := range s.ProfileRules {
+		p, ok := s.Profiles[rule.Profile]
+		if !ok {
+			return fmt.Errorf("profile rule %d: unknown profile %q", i, rule.Profile)
+		}
+		// anyone can load or claim any path, so a path is no reason to
+		// give someone more than the default
+		if rule.Path != "" && !p.within(fallback) {
+			return fmt.Errorf("profile rule %d: path rules can't grant more access than the default profile", i)
+		}
+	}
+	seen := make(map[string]bool)
+	for i := range s.Fields {
+		f := &s.Fields[i]
+		if err := f.validate(); err != nil {
+			return err
+		}
+		if seen[f.Name] {
+			return fmt.Errorf("duplicate field %q", f.Name)
+		}
+		seen[f.Name] = true
+	}
+	s.Counting.validate()
+	for i, dp := range s.DomainPolicies {
+		switch dp.Action {
+		case policyApprove, policyDeny, policyModerate:
+		default:
+			return fmt.Errorf("domain policy %d: unknown action %q", i, dp.Action)
+		}
+	}
+	return nil
+}
+
+// reloadSettings re-reads the settings file, keeping the current settings
+// if the new ones don't load
+func reloadSettings() error {
+	s, err := loadSettings(c.SettingsFile)
+	if err != nil {
+		return err
+	}
+	currentSettings.Store(s)
+	members.setRules(s.Counting)
+	log.Println("reloaded settings from", c.SettingsFile)
+	return nil
+}
+
+// reloadOnHUP reloads the settings whenever the process gets a SIGHUP
+func reloadOnHUP() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		if err := reloadSettings(); err != nil {
+			log.Println("error reloading settings:", err)
+		}
+	}
+}
+
+// Invite profile types
+const (
+	profileMember             = "member"
+	profileMultiChannelGuest  = "multi_channel_guest"
+	profileSingleChannelGuest = "single_channel_guest"
+)
+
+// inviteProfile describes the kind of account an invite creates
+type inviteProfile struct {
+	Type string `json:"type"`
+	// Channels guests are invited to, by ID. Single channel guests use
+	// only the first one.
+	Channels []string `json:"channels"`
+}
+
+func (p inviteProfile) validate() error {
+	switch p.Type {
+	case profileMember:
+	case profileMultiChannelGuest, profileSingleChannelGuest:
+		if len(p.Channels) == 0 {
+			return fmt.Errorf("%s needs at least one channel", p.Type)
+		}
+	default:
+		return fmt.Errorf("unknown type %q", p.Type)
+	}
+	return nil
+}
+
+// within reports whether p gives no more access than q
+func (p inviteProfile) within(q inviteProfile) bool {
+	switch q.Type {
+	case profileMember:
+		return true
+	case profileMultiChannelGuest:
+		return p.Type != profileMember && isSubset(p.channels(), q.Channels)
+	case profileSingleChannelGuest:
+		return p.Type == profileSingleChannelGuest && p.Channels[0] == q.Channels[0]
+	}
+	return false
+}
+
+// channels returns the channels an invite with p actually gets
+func (p inviteProfile) channels() []string {
+	if p.Type == profileSingleChannelGuest {
+		return p.Channels[:1]
+	}
+	return p.Channels
+}
+
+func isSubset(a, b []string) bool {
+	in := stringSet(b...)
+	for _, s := range a {
+		if !in[strings.ToLower(s)] {
+			return false
+		}
+	}
+	return true
+}
+
+// profileRule picks a profile by email domain and/or the path of the page
+// the form was submitted from. Empty conditions match anything. The path
+// comes from the client, so rules with one may only narrow access.
+type profileRule struct {
+	Domain  string `json:"domain"` // example.com or *.example.com
+	Path    string `json:"path"`   // e.g. /partners
+	Profile string `json:"profile"`
+}
+
+func (r profileRule) match(domain, path string) bool {
+	if r.Domain != "" && !domainMatches(r.Domain, domain) {
+		return false
+	}
+	if r.Path != "" && strings.TrimSuffix(r.Path, "/") != strings.TrimSuffix(path, "/") {
+		return false
+	}
+	return true
+}
+
+// profileFor returns the name of the profile to invite email with when
+// they submitted the form from page
+func (s *settings) profileFor(email, page string) string {
+	domain := emailDomain(email)
+	for _, rule := range s.ProfileRules {
+		if rule.match(domain, page) {
+			return rule.Profile
+		}
+	}
+	if _, ok := s.Profiles["default"]; ok {
+		return "default"
+	}
+	return profileMember
+}
+
+// profile looks up a profile by the name profileFor returned
+func (s *settings) profile(name string) (inviteProfile, error) {
+	if p, ok := s.Profiles[name]; ok {
+		return p, nil
+	}
+	if name == profileMember || name == "" {
+		return inviteProfile{Type: profileMember}, nil
+	}
+	return inviteProfile{}, fmt.Errorf("unknown invite profile %q", name)
+}
+
+// Domain policy actions
+const (
+	policyApprove  = "approve"  // invite without moderation
+	policyDeny     = "deny"     // refuse the request
+	policyModerate = "moderate" // always send to the moderation queue
+)
+
+// domainPolicy applies an action to requests from matching domains
+type domainPolicy struct {
+	Domain string `json:"domain"` // example.com or *.example.com
+	Action string `json:"action"`
+}
+
+// domainAction returns the policy action for email, or "" if no policy
+// matches
+func (s *settings) domainAction(email string) string {
+	domain := emailDomain(email)
+	for _, dp := range s.DomainPolicies {
+		if domainMatches(dp.Domain, domain) {
+			return dp.Action
+		}
+	}
+	return ""
+}
+
+// emailDomain returns the lower cased domain part of an address
+func emailDomain(email string) string {
+	i := strings.LastIndex(email, "@")
+	if i < 0 {
+		return ""
+	}
+	return strings.ToLower(email[i+1:])
+}
+
+// domainMatches reports whether domain matches pattern. A pattern of
+// *.example.com matches subdomains of example.com but not example.com
+// itself.
+func domainMatches(pattern, domain string) bool {
+	pattern = strings.ToLower(pattern)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(domain, pattern[1:])
+	}
+	return pattern == domain
+}
@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+func TestProfileWithin(t *testing.T) {
+	member := inviteProfile{Type: profileMember}
+	multi := inviteProfile{Type: profileMultiChannelGuest, Channels: []string{"C1", "C2"}}
+	tests := []struct {
+		name string
+		p, q inviteProfile
+		want bool
+	}{
+		{"member within member", member, member, true},
+		{"guest within member", multi, member, true},
+		{"member within guest", member, multi, false},
+		{"fewer channels", inviteProfile{Type: profileMultiChannelGuest, Channels: []string{"c1"}}, multi, true},
+		{"another channel", inviteProfile{Type: profileMultiChannelGuest, Channels: []string{"C1", "C3"}}, multi, false},
+		{"single within multi", inviteProfile{Type: profileSingleChannelGuest, Channels: []string{"C2", "C9"}}, multi, true},
+		{"single, other channel", inviteProfile{Type: profileSingleChannelGuest, Channels: []string{"C9"}}, multi, false},
+		{"multi within single", inviteProfile{Type: profileMultiChannelGuest, Channels: []string{"C1"}}, inviteProfile{Type: profileSingleChannelGuest, Channels: []string{"C1"}}, false},
+		{"same single", inviteProfile{Type: profileSingleChannelGuest, Channels: []string{"C1"}}, inviteProfile{Type: profileSingleChannelGuest, Channels: []string{"C1", "C2"}}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.p.within(tt.q); got != tt.want {
+			t.Errorf("%s: within = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPathRulesOnlyNarrow(t *testing.T) {
+	profiles := map[string]inviteProfile{
+		"member":  {Type: profileMember},
+		"guests":  {Type: profileMultiChannelGuest, Channels: []string{"C1", "C2"}},
+		"lobby":   {Type: profileSingleChannelGuest, Channels: []string{"C1"}},
+		"default": {Type: profileMultiChannelGuest, Channels: []string{"C1", "C2"}},
+	}
+	tests := []struct {
+		name  string
+		rules []profileRule
+		ok    bool
+	}{
+		{"path narrows", []profileRule{{Path: "/events", Profile: "lobby"}}, true},
+		{"path matches the default", []profileRule{{Path: "/partners", Profile: "guests"}}, true},
+		{"path widens", []profileRule{{Path: "/staff", Profile: "member"}}, false},
+		{"domain widens", []profileRule{{Domain: "example.com", Profile: "member"}}, true},
+		{"domain and path widen", []profileRule{{Domain: "example.com", Path: "/staff", Profile: "member"}}, false},
+		{"unknown profile", []profileRule{{Path: "/events", Profile: "nobody"}}, false},
+	}
+	for _, tt := range tests {
+		s := &settings{Profiles: profiles, ProfileRules: tt.rules}
+		if err := s.validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+
+	// without a default profile people become members, so any path rule
+	// narrows
+	s := &settings{
+		Profiles:     map[string]inviteProfile{"member": {Type: profileMember}},
+		ProfileRules: []profileRule{{Path: "/staff", Profile: "member"}},
+	}
+	if err := s.validate(); err != nil {
+		t.Errorf("a path rule to the member profile without a default: %v", err)
+	}
+}
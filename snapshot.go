@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+)
+
+// snapshot is the last known team info and member counts, saved so that a
+// restart has something better than zero to show until the first scan
+type snapshot struct {
+	Time   time.Time `json:"time"`
+	Name   string    `json:"name"`
+	Domain string    `json:"domain"`
+	Icon   string    `json:"icon"`
+	Users  int64     `json:"users"`
+	Active int64     `json:"active"`
+	// Guests, Deleted and Categories are missing from older snapshots
+	Guests     int64            `json:"guests"`
+	Deleted    int64            `json:"deleted"`
+	Categories map[string]int64 `json:"categories"`
+}
+
+// countsAsOf is when the snapshot the counts were restored from was taken.
+// It only matters while they're stale.
+var countsAsOf time.Time
+
+// loadSnapshot restores the team info and counts saved at path. A missing
+// or unreadable snapshot just means starting from zero.
+func loadSnapshot(path string) {
+	if path == "" {
+		return
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("error reading snapshot:", err)
+		}
+		return
+	}
+	var s snapshot
+	if err := json.Unmarshal(b, &s); err != nil {
+		log.Println("error reading snapshot:", err)
+		return
+	}
+	ourTeam.restore(s.Name, s.Domain, s.Icon)
+	userCount.Set(s.Users)
+	activeUserCount.Set(s.Active)
+	guestCount.Set(s.Guests)
+	deletedUserCount.Set(s.Deleted)
+	for cat, v := range categoryCounts {
+		v.Set(s.Categories[cat])
+	}
+	countsAsOf = s.Time
+	log.Printf("restored %d users, %d active, from a snapshot taken %s", s.Users, s.Active, s.Time.Format(time.RFC3339))
+}
+
+// saveSnapshot writes the current team info and counts to path
+func saveSnapshot(path string) error {
+	if path == "" {
+		return nil
+	}
+	s := snapshot{
+		Time:       time.Now().UTC(),
+		Name:       ourTeam.Name(),
+		Domain:     ourTeam.Domain(),
+		Icon:       ourTeam.Icon(),
+		Users:      userCount.Value(),
+		Active:     activeUserCount.Value(),
+		Guests:     guestCount.Value(),
+		Deleted:    deletedUserCount.Value(),
+		Categories: make(map[string]int64, len(categoryCounts)),
+	}
+	for cat, v := range categoryCounts {
+		s.Categories[cat] = v.Value()
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// stale reports whether the counts still come from a snapshot rather than
+// slack
+func stale() bool {
+	select {
+	case <-members.synced:
+		return false
+	default:
+		return true
+	}
+}
+
+// restore sets the team info from a snapshot
+func (t *team) restore(name, domain, icon string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.name = name
+	t.domain = domain
+	t.iconURL = icon
+}
@@ -8,48 +8,170 @@ var email = body.querySelector('input[name=email]');
 var first_name = body.querySelector('input[name=fname]');
 var last_name = body.querySelector('input[name=lname]');
 var coc = body.querySelector('input[name=coc]');
+var code = body.querySelector('input[name=code]');
+var form_token = body.querySelector('input[name=form_token]');
+var honeypot = body.querySelector('input[name=website]');
+var extra_fields = body.querySelectorAll('[data-field]');
 var button = body.querySelector('button');
+var form = body.querySelector('form');
 
 // remove loading state
 button.className = '';
 
+// start on the proof of work straight away so it's usually done by the
+// time the form is filled in
+var pow = form && form.getAttribute('data-captcha') === 'pow' ?
+  solvePoW(form.getAttribute('data-challenge')) : null;
+
 // capture submit
 body.addEventListener('submit', function(ev){
   ev.preventDefault();
   button.disabled = true;
   button.className = '';
   button.innerHTML = 'Please Wait';
-  invite(coc && coc.checked ? 1 : 0, email.value, first_name.value, last_name.value, document.getElementById("g-recaptcha-response").value, function(err){
-    if (err) {
-      button.removeAttribute('disabled');
-      button.className = 'error';
-      button.innerHTML = err.message;
+  var fields = {};
+  for (var i = 0; i < extra_fields.length; i++) {
+    var field = extra_fields[i];
+    if (field.type === 'checkbox') {
+      fields[field.name] = field.checked ? '1' : '';
     } else {
+      fields[field.name] = field.value;
+    }
+  }
+  send(fields);
+});
+
+function send(fields){
+  captchaResponse(function(captcha_res){
+    var provider = form.getAttribute('data-captcha');
+    invite(coc && coc.checked ? 1 : 0, email.value, first_name.value, last_name.value, captcha_res, provider, code ? code.value : '', fields, function(err, msg){
+      if (err && err.code === 'captcha_unavailable' && provider !== 'pow') {
+        return fallBackToPoW(function(switched){
+          if (switched) return send(fields);
+          showError(err);
+        });
+      }
+      if (err) return showError(err);
       button.className = 'success';
-      button.innerHTML = 'WOOT. Check your email!';
+      button.textContent = msg || 'WOOT. Check your email!';
+    });
+  });
+}
+
+function showError(err){
+  button.removeAttribute('disabled');
+  button.className = 'error';
+  button.textContent = err.message;
+}
+
+// when the captcha provider can't be reached the server may hand out a
+// proof of work challenge instead, which saves reloading the page
+function fallBackToPoW(fn){
+  request
+  .get('/api/v1/challenge')
+  .end(function(res){
+    var body = res.body || {};
+    if (res.error || body.provider !== 'pow') return fn(false);
+    form.setAttribute('data-captcha', 'pow');
+    form.setAttribute('data-challenge', body.challenge);
+    pow = solvePoW(body.challenge);
+    fn(true);
+  });
+}
+
+// fetch the captcha response for whichever provider the page was rendered
+// with
+function captchaResponse(fn){
+  var provider = form.getAttribute('data-captcha');
+  if (pow) {
+    button.innerHTML = 'Checking you\'re human...';
+    return pow.then(fn, function(){ fn(''); });
+  }
+  if (provider === 'recaptcha_v3' && window.grecaptcha) {
+    var sitekey = form.getAttribute('data-sitekey');
+    return grecaptcha.ready(function(){
+      grecaptcha.execute(sitekey, {action: 'invite'}).then(fn);
+    });
+  }
+  var name = form.getAttribute('data-response-field');
+  var field = name && form.querySelector('[name="' + name + '"]');
+  fn(field ? field.value : '');
+}
+
+// find a counter such that sha256(challenge + ':' + counter) starts with
+// the number of zero bits the challenge asks for. The worker does the
+// hashing; browsers that won't run it hash in batches here instead.
+function solvePoW(challenge){
+  return new Promise(function(resolve){
+    if (!window.Worker) return resolve(solvePoWInPage(challenge));
+    var worker;
+    try {
+      worker = new Worker('/static/pow-worker.js');
+    } catch (e) {
+      return resolve(solvePoWInPage(challenge));
     }
+    worker.onmessage = function(ev){
+      worker.terminate();
+      resolve(ev.data);
+    };
+    worker.onerror = function(){
+      worker.terminate();
+      resolve(solvePoWInPage(challenge));
+    };
+    worker.postMessage(challenge);
   });
-});
+}
 
+function solvePoWInPage(challenge){
+  var difficulty = parseInt(challenge.split('.')[1], 10);
+  var encoder = new TextEncoder();
+  var batch = 512;
+  function zeroBits(buf){
+    var bytes = new Uint8Array(buf), n = 0;
+    for (var i = 0; i < bytes.length; i++) {
+      if (bytes[i] === 0) { n += 8; continue; }
+      return n + Math.clz32(bytes[i]) - 24;
+    }
+    return n;
+  }
+  return (async function(){
+    for (var start = 0; ; start += batch) {
+      var digests = [];
+      for (var counter = start; counter < start + batch; counter++) {
+        digests.push(crypto.subtle.digest('SHA-256', encoder.encode(challenge + ':' + counter)));
+      }
+      var sums = await Promise.all(digests);
+      for (var i = 0; i < sums.length; i++) {
+        if (zeroBits(sums[i]) >= difficulty) return challenge + ':' + (start + i);
+      }
+    }
+  })();
+}
 
-function invite(coc, email, first_name, last_name, recaptcha_res, fn){
+function invite(coc, email, first_name, last_name, recaptcha_res, captcha_provider, invite_code, fields, fn){
   request
-  .post('/invite/')
-  .type('form')
+  .post('/api/v1/invite')
+  .type('json')
   .send({
-    coc: coc,
+    coc: !!coc,
     email: email,
-    fname: first_name,
-    lname: last_name,
-    "g-recaptcha-response": recaptcha_res
+    first_name: first_name,
+    last_name: last_name,
+    captcha: recaptcha_res,
+    captcha_provider: captcha_provider,
+    code: invite_code,
+    fields: fields,
+    form_token: form_token ? form_token.value : '',
+    website: honeypot ? honeypot.value : '',
+    page: window.location.pathname
   })
   .end(function(res){
-      console.log(res);
-    if (res.error) {
-      var err = new Error(res.text || 'Server error');
+    var body = res.body || {};
+    if (res.error || body.status === 'error') {
+      var err = new Error(body.message || res.text || 'Server error');
+      err.code = body.code;
       return fn(err);
-    } else {
-        fn(null);
     }
+    fn(null, body.message);
   });
 }
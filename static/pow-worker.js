@@ -0,0 +1,95 @@
+// solves the proof of work challenge off the page's thread. crypto.subtle
+// costs a promise round trip per hash, far too slow for millions of them,
+// so this is a plain SHA-256 that hashes the blocks of the challenge once
+// and then only the block holding the counter.
+
+// everything lives in a function, globals are slow to reach from the loop
+(function(){
+  var K = new Int32Array([
+    0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+    0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+    0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+    0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+    0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+    0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+    0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+    0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2
+  ]);
+
+  var IV = new Int32Array([
+    0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19
+  ]);
+
+  // compress hashes the 64 byte block of buf at off into h
+  function compress(h, buf, off, w){
+    var i;
+    for (i = 0; i < 16; i++, off += 4) {
+      w[i] = buf[off] << 24 | buf[off + 1] << 16 | buf[off + 2] << 8 | buf[off + 3];
+    }
+    for (i = 16; i < 64; i++) {
+      var x = w[i - 15], y = w[i - 2];
+      var s0 = (x >>> 7 | x << 25) ^ (x >>> 18 | x << 14) ^ (x >>> 3);
+      var s1 = (y >>> 17 | y << 15) ^ (y >>> 19 | y << 13) ^ (y >>> 10);
+      w[i] = w[i - 16] + s0 + w[i - 7] + s1 | 0;
+    }
+    var a = h[0], b = h[1], c = h[2], d = h[3], e = h[4], f = h[5], g = h[6], k = h[7];
+    for (i = 0; i < 64; i++) {
+      var t1 = k + ((e >>> 6 | e << 26) ^ (e >>> 11 | e << 21) ^ (e >>> 25 | e << 7)) +
+        ((e & f) ^ (~e & g)) + K[i] + w[i] | 0;
+      var t2 = ((a >>> 2 | a << 30) ^ (a >>> 13 | a << 19) ^ (a >>> 22 | a << 10)) +
+        ((a & b) ^ (a & c) ^ (b & c)) | 0;
+      k = g; g = f; f = e; e = d + t1 | 0;
+      d = c; c = b; b = a; a = t1 + t2 | 0;
+    }
+    h[0] = h[0] + a | 0; h[1] = h[1] + b | 0; h[2] = h[2] + c | 0; h[3] = h[3] + d | 0;
+    h[4] = h[4] + e | 0; h[5] = h[5] + f | 0; h[6] = h[6] + g | 0; h[7] = h[7] + k | 0;
+  }
+
+  function zeroBits(h){
+    for (var i = 0; i < 8; i++) {
+      if (h[i] !== 0) return i * 32 + Math.clz32(h[i]);
+    }
+    return 256;
+  }
+
+  // solve finds a counter such that sha256(challenge + ':' + counter) starts
+  // with the number of zero bits the challenge asks for
+  function solve(challenge){
+    var difficulty = parseInt(challenge.split('.')[1], 10);
+    var prefix = new TextEncoder().encode(challenge + ':');
+    var w = new Int32Array(64);
+    var mid = new Int32Array(IV);
+    var done = prefix.length - prefix.length % 64;
+    for (var off = 0; off < done; off += 64) {
+      compress(mid, prefix, off, w);
+    }
+    var tail = prefix.subarray(done);
+    var buf = new Uint8Array(128);
+    var h = new Int32Array(8);
+    for (var counter = 0; ; counter++) {
+      var digits = String(counter);
+      var n = tail.length + digits.length;
+      var blocks = n + 9 <= 64 ? 1 : 2;
+      var bits = (done + n) * 8;
+      buf.fill(0);
+      buf.set(tail);
+      for (var i = 0; i < digits.length; i++) {
+        buf[tail.length + i] = digits.charCodeAt(i);
+      }
+      buf[n] = 0x80;
+      var end = blocks * 64;
+      buf[end - 4] = bits >>> 24;
+      buf[end - 3] = bits >>> 16;
+      buf[end - 2] = bits >>> 8;
+      buf[end - 1] = bits;
+      h.set(mid);
+      compress(h, buf, 0, w);
+      if (blocks === 2) compress(h, buf, 64, w);
+      if (zeroBits(h) >= difficulty) return challenge + ':' + counter;
+    }
+  }
+
+  self.onmessage = function(ev){
+    self.postMessage(solve(ev.data));
+  };
+})();
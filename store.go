@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outcomes recorded for an invite attempt
+const (
+	outcomeInvited     = "invited"     // slack accepted the invite
+	outcomeFailed      = "failed"      // slack returned an error
+	outcomeRejected    = "rejected"    // the request failed validation or captcha
+	outcomePending     = "pending"     // waiting for a moderator
+	outcomeDenied      = "denied"      // a moderator turned the request down
+	outcomeQueued      = "queued"      // waiting in the delivery queue
+	outcomeUnconfirmed = "unconfirmed" // waiting for the email confirmation link to be followed
+	outcomeSending     = "sending"     // claimed by a moderator or a confirmation, on its way to slack
+)
+
+// ledgerOutcomes lists the outcomes, for searching the ledger
+var ledgerOutcomes = []string{
+	outcomeInvited, outcomeFailed, outcomeRejected, outcomePending, outcomeDenied,
+	outcomeQueued, outcomeUnconfirmed, outcomeSending,
+}
+
+// inviteRecord is a single invite attempt in the ledger
+type inviteRecord struct {
+	ID           string            `json:"id"`
+	Time         time.Time         `json:"time"`
+	Email        string            `json:"email"`
+	FirstName    string            `json:"first_name"`
+	LastName     string            `json:"last_name"`
+	IP           string            `json:"ip"`
+	Outcome      string            `json:"outcome"`
+	Error        string            `json:"error,omitempty"`
+	Code         string            `json:"code,omitempty"`    // stable error code, see errors.go
+	Captcha      string            `json:"captcha,omitempty"` // result of the captcha check
+	CaptchaScore *float64          `json:"captcha_score,omitempty"`
+	RiskAction   string            `json:"risk_action,omitempty"` // what the captcha result said to do
+	Profile      string            `json:"profile,omitempty"`     // name of the invite profile
+	Flags        []string          `json:"flags,omitempty"`       // why the request looked suspicious
+	Moderate     bool              `json:"moderate,omitempty"`    // needs review once confirmed
+	InviteCode   string            `json:"invite_code,omitempty"`
+	Fields       map[string]string `json:"fields,omitempty"` // answers to the extra form fields
+
+	// set when a moderator reviews a pending request
+	Reason     string    `json:"reason,omitempty"`
+	ReviewedBy string    `json:"reviewed_by,omitempty"`
+	ReviewedAt time.Time `json:"reviewed_at,omitempty"`
+}
+
+// inviteQuery filters ledger records. Zero values match everything.
+type inviteQuery struct {
+	Email    string
+	From, To time.Time
+	Outcome  string
+}
+
+func (q inviteQuery) match(r *inviteRecord) bool {
+	if q.Email != "" && !strings.EqualFold(q.Email, r.Email) {
+		return false
+	}
+	if !q.From.IsZero() && r.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !r.Time.Before(q.To) {
+		return false
+	}
+	if q.Outcome != "" && q.Outcome != r.Outcome {
+		return false
+	}
+	return true
+}
+
+// inviteStore persists invite records. Put with an existing ID replaces
+// the stored record.
+type inviteStore interface {
+	Put(rec inviteRecord) error
+	Get(id string) (inviteRecord, bool, error)
+	// Transition applies fn to the record with the given ID and stores the
+	// result, but only if its outcome is still from, so that of two callers
+	// racing to move a record on only one wins. It returns the record as it
+	// now stands and whether fn was applied; the record is zero if there's
+	// no such ID.
+	Transition(id, from string, fn func(*inviteRecord)) (inviteRecord, bool, error)
+	Query(q inviteQuery) ([]inviteRecord, error)
+	Ping() error // checks the store is usable
+	Close() error
+}
+
+// maxRecordLine is the longest ledger line replayed. Requests are capped
+// well below it, so anything longer is damage.
+const maxRecordLine = 1024 * 1024
+
+// fileStore is an inviteStore backed by an append only JSON lines file.
+// The file is replayed into memory on open, later lines win. Rejected
+// requests are dropped once they're older than keepRejected, when the
+// store opens and then once a day, so the file and memory don't grow with
+// every bot that tries.
+type fileStore struct {
+	path         string
+	keepRejected time.Duration
+	mu           sync.RWMutex
+	f            *os.File
+	records      map[string]*inviteRecord
+	lastCompact  time.Time
+}
+
+func openFileStore(path string, keepRejected time.Duration) (*fileStore, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s := &fileStore{path: path, keepRejected: keepRejected, f: f, records: make(map[string]*inviteRecord)}
+	r := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, skipped, err := readLine(r, maxRecordLine)
+		if skipped {
+			log.Printf("skipping line %d of %s, it's over %d bytes", n, path, maxRecordLine)
+		} else if len(line) > 0 {
+			var rec inviteRecord
+			if err := json.Unmarshal(line, &rec); err != nil {
+				// a torn final write shouldn't make the ledger unusable
+				log.Printf("skipping line %d of %s: %v", n, path, err)
+			} else {
+				s.records[rec.ID] = &rec
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.compactLocked(time.Now()); err != nil {
+		s.f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// readLine reads the next line from r, without its newline. Lines longer
+// than max are read past and reported as skipped.
+func readLine(r *bufio.Reader, max int) (line []byte, skipped bool, err error) {
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if !skipped {
+			if len(line)+len(chunk) > max+1 {
+				line, skipped = nil, true
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		return bytes.TrimSuffix(line, []byte("\n")), skipped, err
+	}
+}
+
+func (s *fileStore) Put(rec inviteRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now := time.Now(); now.Sub(s.lastCompact) > 24*time.Hour {
+		if err := s.compactLocked(now); err != nil {
+			log.Println("error compacting invite ledger:", err)
+		}
+	}
+	return s.writeLocked(rec, b)
+}
+
+// compactLocked forgets rejected requests older than s.keepRejected and
+// rewrites the file with one line per record. s.mu must be held.
+func (s *fileStore) compactLocked(now time.Time) error {
+	s.lastCompact = now
+	if s.keepRejected <= 0 {
+		return nil
+	}
+	cut := now.Add(-s.keepRejected)
+	dropped := 0
+	for id, rec := range s.records {
+		if rec.Outcome == outcomeRejected && rec.Time.Before(cut) {
+			delete(s.records, id)
+			dropped++
+		}
+	}
+	if dropped == 0 {
+		return nil
+	}
+	out := make([]*inviteRecord, 0, len(s.records))
+	for _, rec := range s.records {
+		out = append(out, rec)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, rec := range out {
+		if err := enc.Encode(rec); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	nf, err := os.OpenFile(s.path, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	s.f.Close()
+	s.f = nf
+	return nil
+}
+
+// writeLocked appends rec, marshalled as b, to the file. s.mu must be held.
+func (s *fileStore) writeLocked(rec inviteRecord, b []byte) error {
+	if _, err := s.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	s.records[rec.ID] = &rec
+	return nil
+}
+
+func (s *fileStore) Transition(id, from string, fn func(*inviteRecord)) (inviteRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur, ok := s.records[id]
+	if !ok {
+		return inviteRecord{}, false, nil
+	}
+	if cur.Outcome != from {
+		return *cur, false, nil
+	}
+	rec := *cur
+	fn(&rec)
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return *cur, false, err
+	}
+	if err := s.writeLocked(rec, b); err != nil {
+		return *cur, false, err
+	}
+	return rec, true, nil
+}
+
+func (s *fileStore) Get(id string) (inviteRecord, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rec, ok := s.records[id]
+	if !ok {
+		return inviteRecord{}, false, nil
+	}
+	return *rec, true, nil
+}
+
+// Query returns the matching records, oldest first
+func (s *fileStore) Query(q inviteQuery) ([]inviteRecord, error) {
+	s.mu.RLock()
+	var out []inviteRecord
+	for _, rec := range s.records {
+		if q.match(rec) {
+			out = append(out, *rec)
+		}
+	}
+	s.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	return out, nil
+}
+
+// Ping checks the file we're writing to is still the one at path
+func (s *fileStore) Ping() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	open, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	onDisk, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(open, onDisk) {
+		return errors.New(s.path + " was replaced or removed")
+	}
+	return nil
+}
+
+func (s *fileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
+
+// newID returns a random identifier for ledger records
+func newID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileStoreSkipsBadLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "invites.jsonl")
+	lines := []string{
+		`{"id":"a","email":"a@example.com","outcome":"invited"}`,
+		`{"id":"b","first_name":"` + strings.Repeat("x", maxRecordLine) + `"}`,
+		`not json`,
+		`{"id":"c","email":"c@example.com","outcome":"pending"}`,
+		`{"id":"d","email":"d@exa`, // torn final write
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := openFileStore(path, 0)
+	if err != nil {
+		t.Fatalf("a damaged ledger stopped the store opening: %v", err)
+	}
+	defer s.Close()
+	for id, want := range map[string]bool{"a": true, "b": false, "c": true, "d": false} {
+		if _, ok, _ := s.Get(id); ok != want {
+			t.Errorf("record %s loaded %v, want %v", id, ok, want)
+		}
+	}
+	if err := s.Put(inviteRecord{ID: "e", Outcome: outcomeInvited}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileStoreForgetsOldRejections(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "invites.jsonl")
+	s, err := openFileStore(path, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	for _, rec := range []inviteRecord{
+		{ID: "old-rejected", Time: old, Outcome: outcomeRejected},
+		{ID: "old-invited", Time: old, Outcome: outcomeInvited},
+		{ID: "new-rejected", Time: time.Now(), Outcome: outcomeRejected},
+	} {
+		if err := s.Put(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+
+	s, err = openFileStore(path, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for id, want := range map[string]bool{"old-rejected": false, "old-invited": true, "new-rejected": true} {
+		if _, ok, _ := s.Get(id); ok != want {
+			t.Errorf("record %s kept %v, want %v", id, ok, want)
+		}
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "old-rejected") {
+		t.Error("the old rejection is still in the file")
+	}
+}
+
+func TestSearchLedger(t *testing.T) {
+	store, err := openFileStore(filepath.Join(t.TempDir(), "invites.jsonl"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := invites
+	invites = store
+	t.Cleanup(func() { invites = old })
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 12, 0, 0, 0, time.UTC) }
+	for _, rec := range []inviteRecord{
+		{ID: "1", Time: day(1), Email: "gopher@example.com", Outcome: outcomeRejected},
+		{ID: "2", Time: day(2), Email: "Gopher@Example.com", Outcome: outcomeInvited},
+		{ID: "3", Time: day(3), Email: "other@example.com", Outcome: outcomeInvited},
+	} {
+		if err := store.Put(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		query string
+		want  string // IDs, newest first
+	}{
+		{"", ""},
+		{"email=gopher@example.com", "21"},
+		{"outcome=invited", "32"},
+		{"from=2024-03-02&to=2024-03-02", "2"},
+		{"email=gopher@example.com&outcome=rejected", "1"},
+		{"email=nobody@example.com", ""},
+	}
+	for _, tt := range tests {
+		v, _ := url.ParseQuery(tt.query)
+		_, found, err := searchLedger(v)
+		if err != nil {
+			t.Errorf("searchLedger(%q): %v", tt.query, err)
+			continue
+		}
+		var got string
+		for _, rec := range found {
+			got += rec.ID
+		}
+		if got != tt.want {
+			t.Errorf("searchLedger(%q) found %q, want %q", tt.query, got, tt.want)
+		}
+	}
+	if _, _, err := searchLedger(url.Values{"from": {"yesterday"}}); err == nil {
+		t.Error("searchLedger took a bad date")
+	}
+}
+
+func TestCheckLengths(t *testing.T) {
+	long := strings.Repeat("x", 2*1024*1024)
+	tests := []struct {
+		req  inviteRequest
+		code string
+	}{
+		{inviteRequest{Email: "gopher@example.com", FirstName: "Go", LastName: "Pher"}, ""},
+		{inviteRequest{Email: long + "@example.com"}, codeMalformedEmail},
+		{inviteRequest{FirstName: long}, codeInvalidField},
+		{inviteRequest{LastName: long}, codeInvalidField},
+	}
+	for _, tt := range tests {
+		ie := checkLengths(&tt.req)
+		var code string
+		if ie != nil {
+			code = ie.Code
+		}
+		if code != tt.code {
+			t.Errorf("checkLengths(%.20q...) = %q, want %q", tt.req.Email+tt.req.FirstName+tt.req.LastName, code, tt.code)
+		}
+	}
+}
+
+func TestRecoverInterrupted(t *testing.T) {
+	store, err := openFileStore(filepath.Join(t.TempDir(), "invites.jsonl"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := invites
+	invites = store
+	t.Cleanup(func() { invites = old })
+	for _, rec := range []inviteRecord{
+		{ID: "stuck", Outcome: outcomeSending},
+		{ID: "done", Outcome: outcomeInvited},
+	} {
+		if err := store.Put(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := recoverInterrupted(); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _, _ := store.Get("stuck"); rec.Outcome != outcomeFailed {
+		t.Errorf("interrupted send is %s, want %s so it can be retried", rec.Outcome, outcomeFailed)
+	}
+	if rec, _, _ := store.Get("done"); rec.Outcome != outcomeInvited {
+		t.Errorf("finished invite is %s, want it left %s", rec.Outcome, outcomeInvited)
+	}
+}